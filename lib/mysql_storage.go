@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"errors"
+	"feed/storage"
+	"golang.org/x/net/context"
+	"strings"
+)
+
+var (
+	errNilMysqlClient = errors.New("all mysql down")
+	errItemValue      = errors.New("item value must be []byte or string")
+)
+
+type MysqlStorageOpts struct {
+	Table       string
+	KeyColumn   string // 需要唯一索引
+	ValueColumn string
+	LE          func(c context.Context, err error, v ...interface{})
+}
+
+/*
+* 基于mysql的key value存储，实现storage.Storage，作为storage.DefaultProxy的BackupStorage，
+* 表中key和value各占一列；只保存Value，读出的Item没有Flags、DataVersion和过期时间
+ */
+type MysqlStorage struct {
+	pool *MysqlPool
+	opts *MysqlStorageOpts
+	get  string
+	set  string
+	del  string
+}
+
+func NewMysqlStorage(pool *MysqlPool, opts *MysqlStorageOpts) *MysqlStorage {
+	if opts.LE == nil {
+		opts.LE = func(c context.Context, err error, v ...interface{}) {}
+	}
+	return &MysqlStorage{
+		pool: pool,
+		opts: opts,
+		get:  "select " + opts.KeyColumn + ", " + opts.ValueColumn + " from " + opts.Table + " where " + opts.KeyColumn + " in ",
+		set:  "insert into " + opts.Table + "(" + opts.KeyColumn + ", " + opts.ValueColumn + ") values ",
+		del:  "delete from " + opts.Table + " where " + opts.KeyColumn + "=?",
+	}
+}
+
+// Value只支持[]byte和string
+func itemValue(item *storage.Item) (interface{}, error) {
+	switch v := item.Value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return v, nil
+	}
+	return nil, errItemValue
+}
+
+// n个占位符，比如(?,?,?)
+func placeholders(n int) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?,", n), ",") + ")"
+}
+
+func (m *MysqlStorage) getMulti(c context.Context, master bool, keys []string) map[string]*storage.Item {
+	items := make(map[string]*storage.Item, len(keys))
+	if len(keys) == 0 {
+		return items
+	}
+	client := m.pool.GetClient(master)
+	if client == nil {
+		m.opts.LE(c, errNilMysqlClient, " when get from mysql, keys: ", keys)
+		return items
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	rows, err := client.Query(m.get+placeholders(len(keys)), args...)
+	if err != nil {
+		m.opts.LE(c, err, " when get from mysql, keys: ", keys)
+		return items
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			m.opts.LE(c, err, " when scan from mysql")
+			continue
+		}
+		items[key] = &storage.Item{Value: value}
+	}
+	if err := rows.Err(); err != nil {
+		m.opts.LE(c, err, " when get from mysql, keys: ", keys)
+	}
+	return items
+}
+
+// Get retrieves a single value from the storage.
+func (m *MysqlStorage) Get(c context.Context, key string) *storage.Item {
+	return m.getMulti(c, false, []string{key})[key]
+}
+
+// GetMulti retrieves multiple values from the storage.
+func (m *MysqlStorage) GetMulti(c context.Context, keys ...string) map[string]*storage.Item {
+	return m.getMulti(c, false, keys)
+}
+
+// GetFromMaster retrieves a single value from the master.
+func (m *MysqlStorage) GetFromMaster(c context.Context, key string) *storage.Item {
+	return m.getMulti(c, true, []string{key})[key]
+}
+
+// GetMultiFromMaster retrieves multiple values from the master.
+func (m *MysqlStorage) GetMultiFromMaster(c context.Context, keys ...string) map[string]*storage.Item {
+	return m.getMulti(c, true, keys)
+}
+
+// Set stores a single item into the storage.
+func (m *MysqlStorage) Set(c context.Context, key string, item *storage.Item) bool {
+	return m.SetMulti(c, map[string]*storage.Item{key: item})
+}
+
+// SetMulti stores multiple items into the storage with one upsert.
+func (m *MysqlStorage) SetMulti(c context.Context, itemMap map[string]*storage.Item) bool {
+	if len(itemMap) == 0 {
+		return true
+	}
+	args := make([]interface{}, 0, 2*len(itemMap))
+	for key, item := range itemMap {
+		value, err := itemValue(item)
+		if err != nil {
+			m.opts.LE(c, err, " when set on mysql, key: ", key)
+			return false
+		}
+		args = append(args, key, value)
+	}
+	client := m.pool.GetClient(true)
+	if client == nil {
+		m.opts.LE(c, errNilMysqlClient, " when set on mysql")
+		return false
+	}
+	rows := strings.TrimSuffix(strings.Repeat("(?,?),", len(itemMap)), ",")
+	query := m.set + rows + " on duplicate key update " + m.opts.ValueColumn + "=values(" + m.opts.ValueColumn + ")"
+	if _, err := client.Exec(query, args...); err != nil {
+		m.opts.LE(c, err, " when set on mysql")
+		return false
+	}
+	return true
+}
+
+// Delete removes a single item from the storage.
+func (m *MysqlStorage) Delete(c context.Context, key string) bool {
+	client := m.pool.GetClient(true)
+	if client == nil {
+		m.opts.LE(c, errNilMysqlClient, " when delete on mysql, key: ", key)
+		return false
+	}
+	if _, err := client.Exec(m.del, key); err != nil {
+		m.opts.LE(c, err, " when delete on mysql, key: ", key)
+		return false
+	}
+	return true
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strconv"
 
+	"feed/storage"
 	"github.com/gin-gonic/gin"
 	// "github.com/prometheus/client_golang/prometheus"
 )
@@ -19,12 +20,160 @@ func handleVersion(c *gin.Context) {
 	c.String(http.StatusOK, "Meitudns-"+VERSION)
 }
 
+// 输出inbox清理的进度和删除数
+func handleRetentionStats(c *gin.Context) {
+	c.JSON(http.StatusOK, getRetentionStats())
+}
+
+// 手动触发一轮inbox清理
+func handleRetentionRun(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": triggerRetention()})
+}
+
+// 输出动态投递各阶段的延迟分位数和积压数
+func handleLagStats(c *gin.Context) {
+	c.JSON(http.StatusOK, getLagStats())
+}
+
+// 输出producer的投递结果统计
+func handleProducerStats(c *gin.Context) {
+	c.JSON(http.StatusOK, publisher.Stats())
+}
+
+// 输出outbox未发送、搁置的事件数以及relay发送的结果
+func handleOutboxStats(c *gin.Context) {
+	c.JSON(http.StatusOK, getOutboxStats())
+}
+
+// 将搁置的outbox事件放回，由relay重新发送
+func handleOutboxRequeue(c *gin.Context) {
+	n, err := requeueOutboxOfDB()
+	if err != nil {
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requeued": n})
+}
+
+// 输出进程内L1缓存的命中、未命中、淘汰数和大小
+func handleL1Stats(c *gin.Context) {
+	stats := storage.L1Stats{}
+	if l1Storage != nil {
+		stats = l1Storage.Stats()
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// 输出push降级的状态
+func handleDegradeStats(c *gin.Context) {
+	c.JSON(http.StatusOK, getDegradeStats())
+}
+
+func handleNotifyStats(c *gin.Context) {
+	users, subs := hub.stats()
+	c.JSON(http.StatusOK, gin.H{"users": users, "connections": subs})
+}
+
+/*
+* 重置消费位置
+* @param topic: 消费的topic
+* @param partition: 分区，不传时重置所有分区
+* @param offset: oldest、newest或者具体的offset
+ */
+func handleResetOffset(c *gin.Context) {
+	partition, err := strconv.ParseInt(c.DefaultPostForm("partition", "-1"), 10, 32)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	if err := resetOffset(c.PostForm("topic"), int32(partition), c.PostForm("offset")); err != nil {
+		mpLogger.Error(err)
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+/*
+* 按id倒序分页查看死信
+* @param topic: 原消息的topic，不传时查看所有topic
+* @param before: 上一页最后一条的id，不传时从最新开始
+* @param limit: 每页条数
+ */
+func handleGetDeadLetters(c *gin.Context) {
+	before, err := strconv.ParseUint(c.DefaultQuery("before", "0"), 10, 64)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DefaultNum)))
+	if err != nil || limit <= 0 {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	dls, err := getDeadLettersFromDB(c.Query("topic"), before, limit)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": dls})
+}
+
+/*
+* 重放或者丢弃一条死信
+* @param id: 死信的id
+ */
+func handlePostDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseUint(c.PostForm("id"), 10, 64)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	if c.Param("action") == "replay" {
+		err = replayDeadLetter(id)
+	} else if c.Param("action") == "discard" {
+		err = delDeadLetterOfDB(id)
+	} else {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	if err == ErrDeadLetter || err == ErrTopic {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	} else if err != nil {
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
 func (ads *AdminHttpServer) setupRouters() {
 	engine := ads.ginServer
 	// prometheus 统计
 	// engine.GET("/metrics", gin.WrapH(prometheus.Handler()))
 	// 输出版本信息
 	engine.GET("/version", handleVersion)
+	// inbox清理
+	engine.GET("/retention", handleRetentionStats)
+	engine.POST("/retention/run", handleRetentionRun)
+	// 投递延迟
+	engine.GET("/lag", handleLagStats)
+	// producer的投递结果
+	engine.GET("/producer", handleProducerStats)
+	// outbox的发送情况
+	engine.GET("/outbox", handleOutboxStats)
+	engine.POST("/outbox/requeue", handleOutboxRequeue)
+	// L1缓存的命中率
+	engine.GET("/l1", handleL1Stats)
+	// push降级状态
+	engine.GET("/degrade", handleDegradeStats)
+	// 实时通知的在线连接
+	engine.GET("/notify", handleNotifyStats)
+	// 重置消费位置
+	engine.POST("/offsets/reset", handleResetOffset)
+	// 死信的查看、重放和丢弃
+	engine.GET("/deadletters", handleGetDeadLetters)
+	engine.POST("/deadletters/:action", handlePostDeadLetter)
 }
 
 // 后台功能的 http 服务应该只跑在内网的网卡
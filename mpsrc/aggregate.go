@@ -0,0 +1,60 @@
+package mpsrc
+
+const (
+	CardPost  = "post"
+	CardGroup = "group"
+)
+
+//好友动态聚合后的卡片，group表示同一作者短时间内的多条动态（"X发布了N条新动态"）
+type FeedCard struct {
+	Type      string    `json:"type"`
+	UserID    uint64    `json:"userid"`
+	Count     int       `json:"count"`
+	Timestamp uint64    `json:"timestamp"` // 卡片内最新一条动态的时间
+	Items     Timelines `json:"items"`     // 展开后的动态
+}
+
+func newFeedCard(tls Timelines, minPosts int) *FeedCard {
+	last := tls[len(tls)-1]
+	card := &FeedCard{
+		Type:      CardPost,
+		UserID:    last.UserID,
+		Count:     len(tls),
+		Timestamp: last.Timestamp,
+		Items:     tls,
+	}
+	if len(tls) >= minPosts {
+		card.Type = CardGroup
+	}
+	return card
+}
+
+/*
+* 将按时间升序排列的好友动态聚合成卡片：同一作者的相邻动态，如果与该组第一条
+* 的时间差不超过window，则合并到一组；少于minPosts条的组仍按单条动态输出
+ */
+func aggregateTimelines(tls Timelines, window uint64, minPosts int) []*FeedCard {
+	cards := make([]*FeedCard, 0, len(tls))
+	start := 0
+	flush := func(end int) {
+		if end-start >= minPosts {
+			cards = append(cards, newFeedCard(tls[start:end], minPosts))
+			return
+		}
+		for i := start; i < end; i++ {
+			cards = append(cards, newFeedCard(tls[i:i+1], minPosts))
+		}
+	}
+	for i := 1; i < len(tls); i++ {
+		if tls[i].UserID == tls[start].UserID &&
+			tls[i].Timestamp-tls[start].Timestamp <= window {
+			continue
+		}
+		flush(i)
+		start = i
+	}
+	if len(tls) > 0 {
+		flush(len(tls))
+	}
+	return cards
+}
@@ -0,0 +1,27 @@
+package mpsrc
+
+import (
+	"testing"
+)
+
+func TestAggregateTimelines(t *testing.T) {
+	tls := append(newTimelines(1, 100, 200, 300), newTimelines(2, 310)...)
+	tls = append(tls, newTimelines(1, 320, 2000)...)
+
+	cards := aggregateTimelines(tls, 600, 2)
+	if len(cards) != 4 {
+		t.Fatalf("expected: %v cards, got: %v", 4, len(cards))
+	}
+	if cards[0].Type != CardGroup || cards[0].Count != 3 || cards[0].Timestamp != 300 {
+		t.Errorf("Test aggregate group failed, got %+v", cards[0])
+	}
+	for _, card := range cards[1:] {
+		if card.Type != CardPost || card.Count != 1 {
+			t.Errorf("Test aggregate single post failed, got %+v", card)
+		}
+	}
+
+	if len(aggregateTimelines(nil, 600, 2)) != 0 {
+		t.Error("Test aggregate empty timelines failed")
+	}
+}
@@ -0,0 +1,279 @@
+package mpsrc
+
+import (
+	"feed/mq"
+	"strings"
+)
+
+/*
+* 批量写入：写mysql的topic按分区攒批（[batch.表名]的Size条或者Interval），一批消息的写入
+* 按表（分表）合并成多行语句，在一个事务内执行，提交成功后才提交这批消息的offset；
+* 整批失败时按[retry]重试，仍然失败的逐条处理，出错的消息按原来的方式重试并放入死信队列
+ */
+
+//各topic批量写入的表，对应[batch]下的配置，不在其中的topic逐条处理
+var batchTables = map[string]string{
+	ADDFANS:             "fanslist",
+	DELFANS:             "fanslist",
+	ADDLIKES:            "likeslist",
+	DELLIKES:            "likeslist",
+	FRIENDSTIMELINE:     "pushfriendstimeline",
+	ADDPERSONALTIMELINE: "personaltimeline",
+	DELPERSONALTIMELINE: "personaltimeline",
+	ADDVALUE:            "valuestore",
+	DELVALUE:            "valuestore",
+}
+
+var batchHandlers = map[string]mq.BatchHandler{
+	ADDFANS:             handleRelationBatch,
+	DELFANS:             handleRelationBatch,
+	ADDLIKES:            handleRelationBatch,
+	DELLIKES:            handleRelationBatch,
+	FRIENDSTIMELINE:     handlePushFriendsTimelineBatch,
+	ADDPERSONALTIMELINE: handlePersonalTimelineBatch,
+	DELPERSONALTIMELINE: handlePersonalTimelineBatch,
+	ADDVALUE:            handleValueBatch,
+	DELVALUE:            handleValueBatch,
+}
+
+//多行语句的模板：head + row(sep row)* + tail
+type batchStmt struct {
+	head string
+	row  string
+	sep  string
+	tail string
+}
+
+func upsertStmt(table, columns, row, update string) *batchStmt {
+	return &batchStmt{
+		head: "insert into " + table + "(" + columns + ") values ",
+		row:  row,
+		sep:  ",",
+		tail: " on duplicate key update " + update,
+	}
+}
+
+func deleteStmt(table, cond string) *batchStmt {
+	return &batchStmt{
+		head: "delete from " + table + " where ",
+		row:  "(" + cond + ")",
+		sep:  " or ",
+	}
+}
+
+//按语句（即表和分表）缓冲一批行，flush时每条语句执行一次，所有语句在一个事务内
+type batchWriter struct {
+	order []string
+	stmts map[string]*batchStmt
+	rows  map[string]int
+	args  map[string][]interface{}
+}
+
+func newBatchWriter() *batchWriter {
+	return &batchWriter{
+		stmts: make(map[string]*batchStmt),
+		rows:  make(map[string]int),
+		args:  make(map[string][]interface{}),
+	}
+}
+
+func (w *batchWriter) add(stmt *batchStmt, args ...interface{}) {
+	key := stmt.head + stmt.tail
+	if _, ok := w.stmts[key]; !ok {
+		w.order = append(w.order, key)
+		w.stmts[key] = stmt
+	}
+	w.rows[key]++
+	w.args[key] = append(w.args[key], args...)
+}
+
+func (w *batchWriter) query(key string) string {
+	stmt := w.stmts[key]
+	rows := make([]string, w.rows[key])
+	for i := range rows {
+		rows[i] = stmt.row
+	}
+	return stmt.head + strings.Join(rows, stmt.sep) + stmt.tail
+}
+
+func (w *batchWriter) flush() error {
+	if len(w.order) == 0 {
+		return nil
+	}
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return ErrAllMysqlDown
+	}
+	tx, err := client.Begin()
+	if err != nil {
+		mpLogger.Warn(err)
+		return err
+	}
+	for _, key := range w.order {
+		if _, err := tx.Exec(w.query(key), w.args[key]...); err != nil {
+			mpLogger.Warn(err)
+			tx.Rollback()
+			return classifyDBError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		mpLogger.Warn(err)
+		return err
+	}
+	return nil
+}
+
+//与addPersonalTimelineOfDB相同的分表规则
+func personalTimelineTable(uid uint64) string {
+	if hash(uid) == 1 {
+		return "personaltimeline2"
+	}
+	return "personaltimeline1"
+}
+
+//逐条处理一批消息，用于整批失败之后
+func eachMessage(handler mq.Handler) mq.BatchHandler {
+	return func(msgs []*mq.Message) error {
+		var last error
+		for _, msg := range msgs {
+			if err := handler(msg); err != nil {
+				last = err
+			}
+		}
+		return last
+	}
+}
+
+//粉丝列表和关注关系的批量变更，一批消息的topic相同
+func handleRelationBatch(msgs []*mq.Message) error {
+	events := make([]RelationEvent, len(msgs))
+	envs := make([]*Envelope, len(msgs))
+	for i, msg := range msgs {
+		env, err := decodeEvent(msg, &events[i])
+		if err != nil {
+			return err
+		}
+		envs[i] = env
+	}
+	topic := msgs[0].Topic
+	table, vt, infoType := "fanslist", "fid", FANS
+	if topic == ADDLIKES || topic == DELLIKES {
+		table, vt, infoType = "likeslist", "lid", LIKES
+	}
+	w := newBatchWriter()
+	if topic == ADDFANS || topic == ADDLIKES {
+		stmt := upsertStmt(table, "uid, "+vt+", ts", "(?,?,now())", "ts=ts")
+		for _, e := range events {
+			w.add(stmt, e.UserID, e.TargetID)
+		}
+	} else {
+		//附加操作（删除pushtimeline里对方的内容）
+		stmt := deleteStmt(table, "uid=? and "+vt+"=?")
+		push := deleteStmt("pushfriendstimeline", "uid=? and lid=?")
+		for _, e := range events {
+			w.add(stmt, e.UserID, e.TargetID)
+			w.add(push, e.UserID, e.TargetID)
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	for i, e := range events {
+		if topic == ADDLIKES {
+			initSeqSeen(e.UserID, e.TargetID)
+		}
+		clearWrite(e.UserID, relationField(infoType, e.TargetID), envs[i].ID)
+	}
+	return nil
+}
+
+//push动态的批量写入
+func handlePushFriendsTimelineBatch(msgs []*mq.Message) error {
+	setConsumerBacklog(msgs[len(msgs)-1])
+	events := make([]PushEvent, len(msgs))
+	envs := make([]*Envelope, len(msgs))
+	for i, msg := range msgs {
+		env, err := decodeEvent(msg, &events[i])
+		if err != nil {
+			return err
+		}
+		envs[i] = env
+		observeLag(StageConsumer, env.publishedAt())
+	}
+
+	stmt := upsertStmt("pushfriendstimeline", "uid, lid, ts, valuekey", "(?,?,?,?)", "ts=ts")
+	w := newBatchWriter()
+	for _, e := range events {
+		w.add(stmt, e.UserID, e.Author, e.Timestamp, e.ValueKey)
+		enterStage(StageDBWrite)
+	}
+	err := w.flush()
+	for range events {
+		leaveStage(StageDBWrite)
+	}
+	if err != nil {
+		return err
+	}
+	posts := make([]*hubMessage, len(events))
+	for i, e := range events {
+		observeLag(StageDBWrite, envs[i].publishedAt())
+		posts[i] = postMessage(e.UserID, e.Author, e.Timestamp, e.ValueKey)
+	}
+	broadcast(posts...)
+	return nil
+}
+
+//个人动态的批量变更，按用户分表
+func handlePersonalTimelineBatch(msgs []*mq.Message) error {
+	events := make([]TimelineEvent, len(msgs))
+	envs := make([]*Envelope, len(msgs))
+	for i, msg := range msgs {
+		env, err := decodeEvent(msg, &events[i])
+		if err != nil {
+			return err
+		}
+		envs[i] = env
+	}
+	w := newBatchWriter()
+	for _, e := range events {
+		table := personalTimelineTable(e.UserID)
+		if msgs[0].Topic == ADDPERSONALTIMELINE {
+			w.add(upsertStmt(table, "uid, ts, valuekey", "(?,?,?)", "ts=ts"), e.UserID, e.Timestamp, e.ValueKey)
+		} else {
+			w.add(deleteStmt(table, "uid=? and ts=?"), e.UserID, e.Timestamp)
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	for i, e := range events {
+		clearWrite(e.UserID, postField(e.Timestamp), envs[i].ID)
+	}
+	return nil
+}
+
+//value的批量增删
+func handleValueBatch(msgs []*mq.Message) error {
+	events := make([]ValueEvent, len(msgs))
+	for i, msg := range msgs {
+		if _, err := decodeEvent(msg, &events[i]); err != nil {
+			return err
+		}
+	}
+	var stmt *batchStmt
+	if msgs[0].Topic == ADDVALUE {
+		stmt = upsertStmt("valuestore", "valuekey, value", "(?,?)", "value=values(value)")
+	} else {
+		stmt = deleteStmt("valuestore", "value=?")
+	}
+	w := newBatchWriter()
+	for _, e := range events {
+		if msgs[0].Topic == ADDVALUE {
+			w.add(stmt, e.Key, e.Value)
+		} else {
+			w.add(stmt, e.Key)
+		}
+	}
+	return w.flush()
+}
@@ -0,0 +1,30 @@
+package mpsrc
+
+import (
+	"testing"
+)
+
+func TestBatchWriter(t *testing.T) {
+	w := newBatchWriter()
+	insert := upsertStmt("fanslist", "uid, fid, ts", "(?,?,now())", "ts=ts")
+	del := deleteStmt("pushfriendstimeline", "uid=? and lid=?")
+	w.add(insert, 1, 2)
+	w.add(del, 1, 2)
+	w.add(insert, 3, 4)
+
+	//同一条语句的行合并，按第一次出现的顺序执行
+	if len(w.order) != 2 {
+		t.Fatalf("expected 2 statements, got: %d", len(w.order))
+	}
+	expected := "insert into fanslist(uid, fid, ts) values (?,?,now()),(?,?,now()) on duplicate key update ts=ts"
+	if q := w.query(w.order[0]); q != expected {
+		t.Errorf("expected: %v, got: %v", expected, q)
+	}
+	if args := w.args[w.order[0]]; len(args) != 4 || args[2] != 3 {
+		t.Errorf("unexpected args: %v", args)
+	}
+	expected = "delete from pushfriendstimeline where (uid=? and lid=?)"
+	if q := w.query(w.order[1]); q != expected {
+		t.Errorf("expected: %v, got: %v", expected, q)
+	}
+}
@@ -0,0 +1,225 @@
+package mpsrc
+
+import (
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+* 未读数的细分：基于UnreadPosts中的成员（类型:作者id:动态时间）统计，
+* 按作者、按类型（动态、提及、评论）以及按用户自定义的分组统计，
+* 分组是关注对象的集合，存放在 uid+List:分组名 中，分组名的集合存放在 uid+Lists 中
+ */
+const (
+	CategoryAuthor = "author"
+	CategoryType   = "type"
+	CategoryList   = "list"
+)
+
+type UnreadBreakdown struct {
+	Total   uint64            `json:"total"`
+	Authors map[string]uint64 `json:"authors"`
+	Types   map[string]uint64 `json:"types"`
+	Lists   map[string]uint64 `json:"lists"`
+}
+
+//按分类匹配未读成员，authors为分组内的作者
+func matchUnread(category, value string, authors map[string]bool, member string) bool {
+	unreadType, author, _, ok := parseUnreadMember(member)
+	if !ok {
+		return false
+	}
+	switch category {
+	case CategoryType:
+		return unreadType == value
+	case CategoryAuthor:
+		return author == value
+	case CategoryList:
+		return authors[author]
+	}
+	return false
+}
+
+/*
+* 用ZSCAN分批遍历未读成员，每次最多BreakdownScanCount个，
+* zset上限为MaxUnreadPosts，遍历超过上限时停止
+ */
+func scanUnread(conn redis.Conn, userID string, fn func(member string)) error {
+	cursor, scanned := 0, 0
+	for {
+		values, err := redis.Values(conn.Do("ZSCAN", userID+UNREADPOSTS, cursor, "COUNT", BreakdownScanCount))
+		if err != nil {
+			return err
+		}
+		var members []string
+		if _, err = redis.Scan(values, &cursor, &members); err != nil {
+			return err
+		}
+		//返回的是 成员,score 交替的列表
+		for i := 0; i < len(members); i += 2 {
+			fn(members[i])
+		}
+		scanned += len(members) / 2
+		if cursor == 0 || scanned >= MaxUnreadPosts {
+			return nil
+		}
+	}
+}
+
+func getUnreadBreakdown(userID string) (*UnreadBreakdown, error) {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return nil, ErrNilRedisConn
+	}
+	defer conn.Close()
+
+	breakdown := &UnreadBreakdown{
+		Authors: make(map[string]uint64),
+		Types:   make(map[string]uint64),
+		Lists:   make(map[string]uint64),
+	}
+	err := scanUnread(conn, userID, func(member string) {
+		unreadType, author, _, ok := parseUnreadMember(member)
+		if !ok {
+			return
+		}
+		breakdown.Total++
+		breakdown.Authors[author]++
+		breakdown.Types[unreadType]++
+	})
+	if err != nil {
+		return nil, err
+	}
+	//加上pull作者的序号差
+	deltas, _, err := getPullUnread(userID, getFriendsInfo(userID, LIKES))
+	if err != nil {
+		mpLogger.Error(err, userID)
+	}
+	for author, delta := range deltas {
+		breakdown.Total += delta
+		breakdown.Authors[author] += delta
+		breakdown.Types[UnreadPost] += delta
+	}
+
+	lists, err := redis.Strings(conn.Do("SMEMBERS", userID+LISTS))
+	if err != nil || len(lists) == 0 {
+		return breakdown, err
+	}
+	for _, list := range lists {
+		conn.Send("SMEMBERS", userID+LIST+list)
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return breakdown, err
+	}
+	for i, reply := range replies {
+		authors, err := redis.Strings(reply, nil)
+		if err != nil {
+			continue
+		}
+		var count uint64
+		for _, author := range authors {
+			count += breakdown.Authors[author]
+		}
+		breakdown.Lists[lists[i]] = count
+	}
+	return breakdown, nil
+}
+
+//清除某一类未读（某个作者、某种类型或某个分组），返回清除的条数
+func clearUnread(userID, category, value string) (uint64, error) {
+	switch category {
+	case CategoryAuthor, CategoryType, CategoryList:
+	default:
+		return 0, ErrCategory
+	}
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return 0, ErrNilRedisConn
+	}
+	defer conn.Close()
+
+	//分组的作者，同时用于清除pull未读
+	members := make(map[string]bool)
+	if category == CategoryList {
+		list, err := redis.Strings(conn.Do("SMEMBERS", userID+LIST+value))
+		if err != nil {
+			return 0, err
+		}
+		for _, member := range list {
+			members[member] = true
+		}
+	}
+	matched := make([]interface{}, 0)
+	err := scanUnread(conn, userID, func(member string) {
+		if matchUnread(category, value, members, member) {
+			matched = append(matched, member)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	//ZREM是幂等的，分批删除扫描到的成员，扫描之后加入的未读不受影响
+	var removed uint64
+	for begin := 0; begin < len(matched); begin += BreakdownScanCount {
+		end := begin + BreakdownScanCount
+		if end > len(matched) {
+			end = len(matched)
+		}
+		n, err := redis.Uint64(conn.Do("ZREM", redis.Args{}.Add(userID+UNREADPOSTS).Add(matched[begin:end]...)...))
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+
+	//同时清除对应作者的pull未读
+	var authors []uint64
+	switch category {
+	case CategoryAuthor:
+		if author, err := strconv.ParseUint(value, 10, 64); err == nil {
+			authors = []uint64{author}
+		}
+	case CategoryType:
+		if value == UnreadPost {
+			authors = getFriendsInfo(userID, LIKES)
+		}
+	case CategoryList:
+		for member := range members {
+			if author, err := strconv.ParseUint(member, 10, 64); err == nil {
+				authors = append(authors, author)
+			}
+		}
+	}
+	cleared, err := clearPullUnread(userID, authors)
+	return removed + cleared, err
+}
+
+//将关注对象加入或移出自定义分组
+func updateList(userID, list, author, opt string) error {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return ErrNilRedisConn
+	}
+	defer conn.Close()
+	key := userID + LIST + list
+	switch opt {
+	case "add":
+		conn.Send("SADD", key, author)
+		conn.Send("SADD", userID+LISTS, list)
+		_, err := conn.Do("")
+		return err
+	case "delete":
+		if _, err := conn.Do("SREM", key, author); err != nil {
+			return err
+		}
+		//分组为空时从分组名集合中移除
+		n, err := redis.Int(conn.Do("SCARD", key))
+		if err == nil && n == 0 {
+			_, err = conn.Do("SREM", userID+LISTS, list)
+		}
+		return err
+	}
+	return ErrOpt
+}
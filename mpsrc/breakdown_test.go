@@ -0,0 +1,27 @@
+package mpsrc
+
+import (
+	"testing"
+)
+
+func TestMatchUnread(t *testing.T) {
+	authors := map[string]bool{"2": true}
+	cases := []struct {
+		category, value, member string
+		expected                bool
+	}{
+		{CategoryType, UnreadMention, "mention:1:100", true},
+		{CategoryType, UnreadPost, "mention:1:100", false},
+		{CategoryType, UnreadPost, "1:100", true}, //旧格式均为动态
+		{CategoryAuthor, "1", "comment:1:100", true},
+		{CategoryAuthor, "1", "comment:12:100", false},
+		{CategoryList, "friends", "post:2:100", true},
+		{CategoryList, "friends", "post:3:100", false},
+		{CategoryAuthor, "1", "invalid", false},
+	}
+	for _, c := range cases {
+		if got := matchUnread(c.category, c.value, authors, c.member); got != c.expected {
+			t.Errorf("matchUnread(%v, %v, %v) expected: %v, got: %v", c.category, c.value, c.member, c.expected, got)
+		}
+	}
+}
@@ -21,4 +21,14 @@ var (
 	ErrInvalidVersion  error = errors.New("version is invalid")
 	ErrInfoType        error = errors.New("type must be fans or likes")
 	ErrOpt             error = errors.New("opt must be add or delete")
+	ErrCategory        error = errors.New("category must be author, type or list")
+	ErrNotifyType      error = errors.New("type must be follow, like, comment, mention or repost")
+	ErrTopic           error = errors.New("topic is not consumed")
+	ErrOffset          error = errors.New("offset must be oldest, newest or a non-negative number")
+	ErrEvent           error = errors.New("invalid event")
+	ErrID              error = errors.New("id must be a non-negative integer")
+	ErrDeadLetter      error = errors.New("dead letter not found")
+	ErrEventInProgress error = errors.New("event is being processed by another consumer")
+	ErrReplayPosition  error = errors.New("position must be oldest, newest, a non-negative offset or a RFC3339 time")
+	ErrReplayDriver    error = errors.New("replay needs the kafka driver")
 )
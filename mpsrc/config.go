@@ -18,6 +18,18 @@ type TomlConfig struct {
 	Http      HttpConfig      `toml:http`
 	Memcached MemcachedConfig `toml:memcached`
 	Kafka     KafkaConfig     `toml:kafka`
+	Pull      PullConfig      `toml:"pull"`
+	Retention RetentionConfig `toml:"retention"`
+	Aggregate AggregateConfig `toml:"aggregate"`
+	Degrade   DegradeConfig   `toml:"degrade"`
+	Notify    NotifyConfig    `toml:"notify"`
+	Retry     RetryConfig     `toml:"retry"`
+	Dedupe    DedupeConfig    `toml:"dedupe"`
+	Batch     map[string]BatchConfig `toml:"batch"`
+	Outbox    OutboxConfig    `toml:"outbox"`
+	Session   SessionConfig   `toml:"session"`
+	L1        L1Config        `toml:"l1"`
+	Coalesce  CoalesceConfig  `toml:"coalesce"`
 }
 
 type HttpConfig struct {
@@ -62,14 +74,142 @@ type MemcachedConfig struct {
 }
 
 type KafkaConfig struct {
-	Addr    string
-	ProAddr string
+	Driver         string        // kafka或memory，memory为进程内的队列，只用于单机部署和测试
+	Addr           string
+	ProAddr        string
+	Version        string        // kafka的协议版本
+	Group          string        // 消费组
+	InitialOffset  string        // 没有提交过offset时从newest还是oldest开始消费
+	CommitInterval time.Duration // 提交offset的间隔
+	SyncPublish    bool          // 关注关系和删除等关键的写入是否等待kafka确认后才返回
+}
+
+type PullConfig struct {
+	Workers int           // 同时拉取的关注对象数上限
+	Timeout time.Duration // 单次请求拉取的整体超时
+}
+
+type RetentionConfig struct {
+	MaxCount  int           // 每个用户pushfriendstimeline保留的最大条数，0表示不按条数清理
+	MaxAge    int64         // 保留的最长时间(s)，0表示不按时间清理
+	BatchSize int           // 每批处理的用户数
+	Throttle  time.Duration // 批次之间的间隔
+	Interval  time.Duration // 两轮清理之间的间隔
+}
+
+type AggregateConfig struct {
+	Window   uint64 // 同一作者的连续动态在该时间窗口(s)内会被合并
+	MinPosts int    // 至少多少条连续动态才合并成一张卡片
+}
+
+type DegradeConfig struct {
+	ProducerBacklog int64         // producer积压超过该值时降级为只pull
+	ConsumerBacklog int64         // consumer积压超过该值时降级为只pull
+	RecoverRatio    float64       // 积压均低于阈值*RecoverRatio时恢复push
+	HoldTime        time.Duration // 降级后至少保持的时间
+	Interval        time.Duration // 检查积压的间隔
+}
+
+type NotifyConfig struct {
+	Heartbeat    time.Duration // SSE连接的心跳间隔
+	PollTimeout  time.Duration // 长轮询最长的等待时间
+	ResumeWindow time.Duration // 断开后保留事件以便通过Last-Event-ID续传的时间
+	Backlog      int           // 每个用户保留的最近事件数
+	Buffer       int           // 每个连接的发送缓冲，写满说明客户端过慢，断开后由客户端续传
+	Channel      string        // 向所有实例广播事件的redis频道，同一个集群的实例需要相同
+}
+
+type RetryConfig struct {
+	MaxAttempts    int           // 写入失败时包括第一次在内的最大尝试次数，耗尽后放入死信队列
+	InitialBackoff time.Duration // 第一次重试前的等待时间，之后每次翻倍
+	MaxBackoff     time.Duration // 等待时间的上限
+}
+
+type DedupeConfig struct {
+	Window time.Duration // 已处理的事件id保留的时间(s)，窗口内重复投递的事件会被跳过
+	Lease  time.Duration // 处理中的事件占用的时间，超时后其他consumer可以重新处理
+}
+
+type OutboxConfig struct {
+	Enabled     bool          // 发布、删除动态和关注关系时主表与事件在同一个事务内写入，由relay放入队列
+	Interval    time.Duration // relay检查未发送事件的间隔
+	BatchSize   int           // relay每批发送的事件数
+	Retention   time.Duration // 已发送的事件保留的时间(s)
+	Lease       time.Duration // relay的租约时间(ms)，多个实例中只有持有租约的一个发送
+	MaxAttempts int           // 一个事件发送失败这么多次后搁置，不再阻塞之后的事件
+}
+
+type SessionConfig struct {
+	Window time.Duration // 用户写入后读自己的数据时读master并合并未写入操作的时间(s)，小于0时关闭
+}
+
+type L1Config struct {
+	MaxBytes int64         // 进程内缓存的大小上限(byte)，为0时不使用
+	TTL      time.Duration // 进程内缓存的过期时间(ms)，只缓存很短的时间
+}
+
+type CoalesceConfig struct {
+	RefreshAhead time.Duration // 缓存过期前多久(s)被读取时在后台提前重新加载，为0时不提前加载
+}
+
+//按表配置consumer的批量写入，[batch.表名]
+type BatchConfig struct {
+	Size     int           // 每批最多的消息数，为1时逐条写入
+	Interval time.Duration // 一批消息最长的等待时间
 }
 
 const (
 	DEFAULT_MAINDIR = "/usr/local/feed"
 	DEFAULT_LOGSDIR = "/www/feed/logs"
 	DEFAULT_CONF    = "./conf/feed-for-test.toml"
+
+	DEFAULT_KAFKA_GROUP           = "feed"
+	DEFAULT_KAFKA_COMMIT_INTERVAL = time.Second
+
+	DEFAULT_PULL_WORKERS = 16
+	DEFAULT_PULL_TIMEOUT = 500 * time.Millisecond
+
+	DEFAULT_RETENTION_BATCH    = 100
+	DEFAULT_RETENTION_THROTTLE = 100 * time.Millisecond
+	DEFAULT_RETENTION_INTERVAL = time.Hour
+
+	DEFAULT_AGGREGATE_WINDOW    = 600
+	DEFAULT_AGGREGATE_MIN_POSTS = 2
+
+	DEFAULT_DEGRADE_PRODUCER_BACKLOG = 10000
+	DEFAULT_DEGRADE_CONSUMER_BACKLOG = 100000
+	DEFAULT_DEGRADE_RECOVER_RATIO    = 0.5
+	DEFAULT_DEGRADE_HOLD_TIME        = 30 * time.Second
+	DEFAULT_DEGRADE_INTERVAL         = time.Second
+
+	DEFAULT_NOTIFY_HEARTBEAT     = 15 * time.Second
+	DEFAULT_NOTIFY_POLL_TIMEOUT  = 30 * time.Second
+	DEFAULT_NOTIFY_RESUME_WINDOW = 5 * time.Minute
+	DEFAULT_NOTIFY_BACKLOG       = 64
+	DEFAULT_NOTIFY_BUFFER        = 16
+	DEFAULT_NOTIFY_CHANNEL       = "feed:notify"
+
+	DEFAULT_RETRY_MAX_ATTEMPTS    = 5
+	DEFAULT_RETRY_INITIAL_BACKOFF = 100 * time.Millisecond
+	DEFAULT_RETRY_MAX_BACKOFF     = 10 * time.Second
+
+	DEFAULT_DEDUPE_WINDOW = 24 * time.Hour
+	DEFAULT_DEDUPE_LEASE  = time.Minute
+
+	DEFAULT_BATCH_SIZE     = 100
+	DEFAULT_BATCH_INTERVAL = 50 * time.Millisecond
+
+	DEFAULT_REPLAY_RATE = 500
+
+	DEFAULT_OUTBOX_INTERVAL  = 200 * time.Millisecond
+	DEFAULT_OUTBOX_BATCH     = 100
+	DEFAULT_OUTBOX_RETENTION = 24 * time.Hour
+	DEFAULT_OUTBOX_LEASE     = 10 * time.Second
+	DEFAULT_OUTBOX_ATTEMPTS  = 10
+
+	DEFAULT_SESSION_WINDOW = time.Minute
+
+	DEFAULT_L1_TTL = time.Second
 )
 
 func loadConfig(conf string) (*TomlConfig, error) {
@@ -106,8 +246,218 @@ func setMemchacheDefault() {
 	//todo
 }
 
-func setKafkaDefault() {
-	//todo 
+func setKafkaDefault(k *KafkaConfig) {
+	if k.Driver == "" {
+		k.Driver = MQKafka
+	}
+	if k.Group == "" {
+		k.Group = DEFAULT_KAFKA_GROUP
+	}
+	if k.InitialOffset != OffsetOldest {
+		k.InitialOffset = OffsetNewest
+	}
+	if k.CommitInterval > 0 {
+		k.CommitInterval = k.CommitInterval * time.Millisecond
+	} else {
+		k.CommitInterval = DEFAULT_KAFKA_COMMIT_INTERVAL
+	}
+}
+
+func setPullDefault(p *PullConfig) {
+	if p.Workers <= 0 {
+		p.Workers = DEFAULT_PULL_WORKERS
+	}
+	if p.Timeout > 0 {
+		p.Timeout = p.Timeout * time.Millisecond
+	} else {
+		p.Timeout = DEFAULT_PULL_TIMEOUT
+	}
+}
+
+func setRetentionDefault(r *RetentionConfig) {
+	if r.MaxCount < 0 {
+		r.MaxCount = 0
+	}
+	if r.MaxAge < 0 {
+		r.MaxAge = 0
+	}
+	if r.BatchSize <= 0 {
+		r.BatchSize = DEFAULT_RETENTION_BATCH
+	}
+	if r.Throttle > 0 {
+		r.Throttle = r.Throttle * time.Millisecond
+	} else {
+		r.Throttle = DEFAULT_RETENTION_THROTTLE
+	}
+	if r.Interval > 0 {
+		r.Interval = r.Interval * time.Millisecond
+	} else {
+		r.Interval = DEFAULT_RETENTION_INTERVAL
+	}
+}
+
+func setAggregateDefault(a *AggregateConfig) {
+	if a.Window == 0 {
+		a.Window = DEFAULT_AGGREGATE_WINDOW
+	}
+	if a.MinPosts < 2 {
+		a.MinPosts = DEFAULT_AGGREGATE_MIN_POSTS
+	}
+}
+
+func setDegradeDefault(d *DegradeConfig) {
+	if d.ProducerBacklog <= 0 {
+		d.ProducerBacklog = DEFAULT_DEGRADE_PRODUCER_BACKLOG
+	}
+	if d.ConsumerBacklog <= 0 {
+		d.ConsumerBacklog = DEFAULT_DEGRADE_CONSUMER_BACKLOG
+	}
+	if d.RecoverRatio <= 0 || d.RecoverRatio > 1 {
+		d.RecoverRatio = DEFAULT_DEGRADE_RECOVER_RATIO
+	}
+	if d.HoldTime > 0 {
+		d.HoldTime = d.HoldTime * time.Millisecond
+	} else {
+		d.HoldTime = DEFAULT_DEGRADE_HOLD_TIME
+	}
+	if d.Interval > 0 {
+		d.Interval = d.Interval * time.Millisecond
+	} else {
+		d.Interval = DEFAULT_DEGRADE_INTERVAL
+	}
+}
+
+func setNotifyDefault(n *NotifyConfig) {
+	if n.Heartbeat > 0 {
+		n.Heartbeat = n.Heartbeat * time.Millisecond
+	} else {
+		n.Heartbeat = DEFAULT_NOTIFY_HEARTBEAT
+	}
+	if n.PollTimeout > 0 {
+		n.PollTimeout = n.PollTimeout * time.Millisecond
+	} else {
+		n.PollTimeout = DEFAULT_NOTIFY_POLL_TIMEOUT
+	}
+	if n.ResumeWindow > 0 {
+		n.ResumeWindow = n.ResumeWindow * time.Millisecond
+	} else {
+		n.ResumeWindow = DEFAULT_NOTIFY_RESUME_WINDOW
+	}
+	if n.Backlog <= 0 {
+		n.Backlog = DEFAULT_NOTIFY_BACKLOG
+	}
+	if n.Buffer <= 0 {
+		n.Buffer = DEFAULT_NOTIFY_BUFFER
+	}
+	if n.Channel == "" {
+		n.Channel = DEFAULT_NOTIFY_CHANNEL
+	}
+}
+
+func setRetryDefault(r *RetryConfig) {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = DEFAULT_RETRY_MAX_ATTEMPTS
+	}
+	if r.InitialBackoff > 0 {
+		r.InitialBackoff = r.InitialBackoff * time.Millisecond
+	} else {
+		r.InitialBackoff = DEFAULT_RETRY_INITIAL_BACKOFF
+	}
+	if r.MaxBackoff > 0 {
+		r.MaxBackoff = r.MaxBackoff * time.Millisecond
+	} else {
+		r.MaxBackoff = DEFAULT_RETRY_MAX_BACKOFF
+	}
+	if r.MaxBackoff < r.InitialBackoff {
+		r.MaxBackoff = r.InitialBackoff
+	}
+}
+
+func setDedupeDefault(d *DedupeConfig) {
+	if d.Window > 0 {
+		d.Window = d.Window * time.Second
+	} else {
+		d.Window = DEFAULT_DEDUPE_WINDOW
+	}
+	if d.Lease > 0 {
+		d.Lease = d.Lease * time.Millisecond
+	} else {
+		d.Lease = DEFAULT_DEDUPE_LEASE
+	}
+}
+
+func setOutboxDefault(o *OutboxConfig) {
+	if o.Interval > 0 {
+		o.Interval = o.Interval * time.Millisecond
+	} else {
+		o.Interval = DEFAULT_OUTBOX_INTERVAL
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DEFAULT_OUTBOX_BATCH
+	}
+	if o.Retention > 0 {
+		o.Retention = o.Retention * time.Second
+	} else {
+		o.Retention = DEFAULT_OUTBOX_RETENTION
+	}
+	if o.Lease > 0 {
+		o.Lease = o.Lease * time.Millisecond
+	} else {
+		o.Lease = DEFAULT_OUTBOX_LEASE
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DEFAULT_OUTBOX_ATTEMPTS
+	}
+}
+
+func setSessionDefault(s *SessionConfig) {
+	if s.Window > 0 {
+		s.Window = s.Window * time.Second
+	} else if s.Window == 0 {
+		s.Window = DEFAULT_SESSION_WINDOW
+	}
+}
+
+func setL1Default(l *L1Config) {
+	if l.MaxBytes < 0 {
+		l.MaxBytes = 0
+	}
+	if l.TTL > 0 {
+		l.TTL = l.TTL * time.Millisecond
+	} else {
+		l.TTL = DEFAULT_L1_TTL
+	}
+}
+
+func setCoalesceDefault(co *CoalesceConfig) {
+	if co.RefreshAhead > 0 {
+		co.RefreshAhead = co.RefreshAhead * time.Second
+	} else {
+		co.RefreshAhead = 0
+	}
+}
+
+func setBatchDefault(b *map[string]BatchConfig) {
+	if *b == nil {
+		*b = make(map[string]BatchConfig)
+	}
+	seen := make(map[string]bool)
+	for _, table := range batchTables {
+		if seen[table] {
+			continue
+		}
+		seen[table] = true
+		bc, ok := (*b)[table]
+		if ok && bc.Interval > 0 {
+			bc.Interval = bc.Interval * time.Millisecond
+		} else {
+			bc.Interval = DEFAULT_BATCH_INTERVAL
+		}
+		if bc.Size <= 0 {
+			bc.Size = DEFAULT_BATCH_SIZE
+		}
+		(*b)[table] = bc
+	}
 }
 
 func setDBDefault(db *DBConfig) {
@@ -137,6 +487,19 @@ func (c *TomlConfig) setDefault() {
 	}
 	setRedisDefault(&c.Redis)
 	setDBDefault(&c.DB)
+	setKafkaDefault(&c.Kafka)
+	setPullDefault(&c.Pull)
+	setRetentionDefault(&c.Retention)
+	setAggregateDefault(&c.Aggregate)
+	setDegradeDefault(&c.Degrade)
+	setNotifyDefault(&c.Notify)
+	setRetryDefault(&c.Retry)
+	setDedupeDefault(&c.Dedupe)
+	setBatchDefault(&c.Batch)
+	setOutboxDefault(&c.Outbox)
+	setSessionDefault(&c.Session)
+	setL1Default(&c.L1)
+	setCoalesceDefault(&c.Coalesce)
 }
 
 func (r *RedisConfig) toString() string {
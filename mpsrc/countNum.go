@@ -1,90 +1,205 @@
 package mpsrc
 
 import (
-	"github.com/Shopify/sarama"
+	"feed/mq"
+	"github.com/garyburd/redigo/redis"
 	"strconv"
+	"strings"
 )
 
-//timeline的属性（获赞数一类的）用redis存储
-func handleFansUnread(fans []uint64, opt string) {
+/*
+* 未读数基于每个用户的已读位置（ReadCursor，动态的时间戳）：
+* push集合内的粉丝（按时间排序的前PushLimitNum个）的未读动态存放在zset（UnreadPosts）中，
+* score为动态时间，只有晚于已读位置的动态才会加入，删除动态时移除对应的成员，
+* 标记已读时在同一个脚本内推进已读位置并清理已读的动态，保证原子性；
+* 其余粉丝的未读由作者的动态序号计算，见sequence.go
+ */
+var (
+	//KEYS按 未读zset,已读位置,已读序号 三个一组，一次处理一批粉丝
+	//ARGV: 动态时间,成员,zset上限,作者id,作者序号（0表示不是动态，不推进已读序号）
+	unreadPushScript = redis.NewScript(-1, `
+local ts = tonumber(ARGV[1])
+local seq = tonumber(ARGV[5])
+local added = 0
+for i = 1, #KEYS, 3 do
+	local cursor = tonumber(redis.call('GET', KEYS[i + 1]) or '0')
+	if ts > cursor then
+		redis.call('ZADD', KEYS[i], ts, ARGV[2])
+		redis.call('ZREMRANGEBYRANK', KEYS[i], 0, -(tonumber(ARGV[3]) + 1))
+		added = added + 1
+	end
+	if seq > 0 and seq > tonumber(redis.call('HGET', KEYS[i + 2], ARGV[4]) or '0') then
+		redis.call('HSET', KEYS[i + 2], ARGV[4], seq)
+	end
+end
+return added`)
+
+	markReadScript = redis.NewScript(2, `
+local cursor = tonumber(redis.call('GET', KEYS[2]) or '0')
+local upto = tonumber(ARGV[1])
+if upto == 0 then
+	local newest = redis.call('ZREVRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	if #newest > 0 then
+		upto = tonumber(newest[2])
+	end
+end
+local unread = redis.call('ZCOUNT', KEYS[1], '(' .. cursor, '+inf')
+if upto > cursor then
+	cursor = upto
+	redis.call('SET', KEYS[2], cursor)
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', cursor)
+return {unread, redis.call('ZCARD', KEYS[1]), cursor}`)
+)
+
+//未读成员的格式为 类型:作者id:动态时间
+func unreadMember(unreadType, author, ts string) string {
+	return unreadType + ":" + author + ":" + ts
+}
+
+//解析未读成员，兼容没有类型的旧格式（作者id:动态时间），旧格式均为动态
+func parseUnreadMember(member string) (unreadType, author, ts string, ok bool) {
+	fields := strings.Split(member, ":")
+	switch len(fields) {
+	case 2:
+		return UnreadPost, fields[0], fields[1], true
+	case 3:
+		return fields[0], fields[1], fields[2], true
+	}
+	return "", "", "", false
+}
+
+/*
+* 批量更新粉丝的未读动态：增加时每UnreadBatchSize个粉丝执行一次脚本，
+* 删除时用pipeline一次提交，seq为作者的动态序号；
+* 加入、移除成员和推进已读序号都是幂等的，失败时返回错误，整条消息重试
+ */
+func handleFansUnread(fans []uint64, opt, member, ts, author string, seq uint64) error {
+	if len(fans) == 0 {
+		return nil
+	}
 	conn := redisPool.GetClient(true)
 	if conn == nil {
-		return
+		return ErrNilRedisConn
 	}
 	defer conn.Close()
 
-	for _, fan := range fans {
-		key := strconv.Itoa(int(fan)) + UNREAD
-		_, err := conn.Do("WATCH", key)
-		if err != nil {
-			mpLogger.Error(err, key)
-			return
+	if opt == "increase" {
+		if err := unreadPushScript.Load(conn); err != nil {
+			return err
 		}
-		_, err = conn.Do("MULTI")
-		if err != nil {
-			mpLogger.Error(err, key)
-			return
+	}
+	for begin := 0; begin < len(fans); begin += UnreadBatchSize {
+		end := begin + UnreadBatchSize
+		if end > len(fans) {
+			end = len(fans)
 		}
-		_, err = conn.Do(opt, key)
-		if err != nil {
-			mpLogger.Error(err, key)
-			return
+		var err error
+		if opt == "increase" {
+			args := redis.Args{}.Add((end - begin) * 3)
+			for _, fan := range fans[begin:end] {
+				uid := strconv.FormatUint(fan, 10)
+				args = args.Add(uid+UNREADPOSTS, uid+READCURSOR, uid+SEQSEEN)
+			}
+			args = args.Add(ts, member, MaxUnreadPosts, author, seq)
+			err = unreadPushScript.SendHash(conn, args...)
+		} else {
+			for _, fan := range fans[begin:end] {
+				if err = conn.Send("ZREM", strconv.FormatUint(fan, 10)+UNREADPOSTS, member); err != nil {
+					break
+				}
+			}
 		}
-		_, err = conn.Do("EXEC")
 		if err != nil {
-			mpLogger.Error(err, key)
-			return
+			return err
 		}
 	}
+	//pipeline中单条命令的错误在回复中返回，任何一条失败都需要重试整条消息
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return err
+	}
+	return replyError(replies)
 }
 
-//通知所有fans列表里的对象,更新未读数
-func handleDataChange(cm *sarama.ConsumerMessage) {
-	key := string(cm.Key)
-	value := string(cm.Value)
-	if key != "increase" && key != "decrease" {
-		return
-	}
-	fans := getFriendsInfo(value, FANS)
-	if key == "increase" {
-		go handleFansUnread(fans, "INCR")
-	} else {
-		go handleFansUnread(fans, "DECR")
+//返回pipeline回复中的第一个错误
+func replyError(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
 	}
+	return nil
 }
 
-func watchDataChange() {
-	consumer, err := sarama.NewConsumer([]string{config.Kafka.Addr}, nil)
+/*
+* 标记已读并返回标记前的未读数，upto为0时标记全部已读，
+* 否则只把不晚于upto的动态标记为已读
+ */
+func markRead(userID string, upto uint64) (unread, left, cursor uint64, err error) {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return 0, 0, 0, ErrNilRedisConn
+	}
+	defer conn.Close()
+	rs, err := redis.Values(markReadScript.Do(conn, userID+UNREADPOSTS, userID+READCURSOR, upto))
 	if err != nil {
-		panic(err)
+		return 0, 0, 0, err
 	}
+	_, err = redis.Scan(rs, &unread, &left, &cursor)
+	return unread, left, cursor, err
+}
 
-	defer func() {
-		if err := consumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-
-	unReadPartitionConsumer, err := consumer.ConsumePartition(UNREAD, 0, sarama.OffsetNewest)
+//获取未读数并全部标记为已读，包括push的未读和pull作者的序号差
+func resetUnread(userID string) (uint64, error) {
+	unread, _, _, err := markRead(userID, 0)
 	if err != nil {
-		panic(err)
-		return
+		return 0, err
 	}
+	pullUnread, err := clearPullUnread(userID, getFriendsInfo(userID, LIKES))
+	return unread + pullUnread, err
+}
 
-	defer func() {
-		if err := unReadPartitionConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-PartitionConsumerLoop:
-	for {
-		select {
-		case cm := <-unReadPartitionConsumer.Messages():
-			handleDataChange(cm)
-		case <-Stop:
-			break PartitionConsumerLoop
+/*
+* 更新未读数：动态递增作者序号并只通知push集合内的粉丝，提及和评论只通知指定的用户；
+* 写入redis完成后才返回，失败时返回错误由重试和死信处理，重试时序号不会重复递增
+* key: 动态的作者id或者通知的接收者id，用于分区
+ */
+func handleDataChange(msg *mq.Message) error {
+	setConsumerBacklog(msg)
+	var event UnreadChangeEvent
+	env, err := decodeEvent(msg, &event)
+	if err != nil {
+		return err
+	}
+	if event.Op != "increase" && event.Op != "decrease" {
+		return mq.Permanent(ErrEvent)
+	}
+	publishedAt := env.publishedAt()
+	observeLag(StageConsumer, publishedAt)
+	author := strconv.FormatUint(event.Author, 10)
+	ts := strconv.FormatUint(event.Timestamp, 10)
+	var (
+		receivers []uint64
+		seq       uint64
+	)
+	if event.Type == UnreadPost {
+		if event.Op == "increase" {
+			if seq, err = incrPostSeq(author, eventKey(msg)); err != nil {
+				return err
+			}
 		}
+		receivers = getPushFans(author)
+	} else {
+		receivers = []uint64{event.Receiver}
+	}
+	member := unreadMember(event.Type, author, ts)
+	enterStage(StageUnread)
+	defer leaveStage(StageUnread)
+	if err := handleFansUnread(receivers, event.Op, member, ts, author, seq); err != nil {
+		return err
 	}
+	notifyUnread(event.Op, event.Type, author, ts, receivers)
+	observeLag(StageUnread, publishedAt)
+	return nil
 }
@@ -0,0 +1,17 @@
+package mpsrc
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestReplyError(t *testing.T) {
+	if err := replyError([]interface{}{int64(1), []byte("OK")}); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	noScript := redis.Error("NOSCRIPT No matching script")
+	if err := replyError([]interface{}{int64(1), noScript, redis.Error("OOM")}); err != noScript {
+		t.Errorf("expected the first error, got: %v", err)
+	}
+}
@@ -3,23 +3,52 @@ package mpsrc
 import (
 	// "fmt"
 	"database/sql"
-	"golang.org/x/net/context"
+	"feed/mq"
+	"github.com/go-sql-driver/mysql"
+	"strconv"
+	"strings"
 )
 
-func getInfo(tablename, vt, userID, key string) []uint64 {
+/*
+* 写入错误的分类：语法错误、表或字段不存在、数据不合法等重试也不会成功，标记为不可重试，
+* 其余（mysql不可用、连接断开、超时、死锁等）由consumer按退避重试；
+* 写入都使用upsert或ignore，重复写入（比如重放或重试之前的写入其实已经成功）视为成功
+ */
+func classifyDBError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if me, ok := err.(*mysql.MySQLError); ok {
+		switch me.Number {
+		case 1062:
+			return nil
+		case 1054, 1064, 1146, 1264, 1364, 1366, 1406, 1452:
+			return mq.Permanent(err)
+		}
+	}
+	return err
+}
+
+//limit大于0时只取按时间排序的前limit个
+//master为true时读主库，用于刚写入过的用户
+func getInfo(tablename, vt, userID, key string, limit int, master bool) []uint64 {
 
 	var userIDs []uint64
 	var uid uint64
-	client := mysqlPool.GetClient(false)
+	client := mysqlPool.GetClient(master)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
 		return userIDs
 	}
-	rows, err := client.Query("select "+vt+" from "+tablename+" where uid=? order by ts ASC", userID)
+	query := "select " + vt + " from " + tablename + " where uid=? order by ts ASC"
+	if limit > 0 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+	rows, err := client.Query(query, userID)
 	switch err {
 		case sql.ErrNoRows:
 			//回写脏数据
-			storageProxy.Set(context.Background(), key, ErrorResult)
+			setCache(key, ErrorResult)
 			return userIDs
 		case nil:
 		default :
@@ -39,49 +68,89 @@ func getInfo(tablename, vt, userID, key string) []uint64 {
 	//set cache
 	go func(userIDs []uint64, key string) {
 		if item, _, err := setItem(userIDs, 0); err == nil {
-			storageProxy.Set(context.Background(), key, item)
+			setCache(key, item)
 		}
 	}(userIDs, key)
 	return userIDs
 }
 
-func getFriendsInfoFromDB(userID string, infoType, key string) []uint64 {
+func getFriendsInfoFromDB(userID string, infoType, key string, master bool) []uint64 {
 	switch infoType {
 	case FANS:
-		return getInfo("fanslist", "fid", userID, key)
+		return getInfo("fanslist", "fid", userID, key, 0, master)
 	case LIKES:
-		return getInfo("likeslist", "lid", userID, key)
+		return getInfo("likeslist", "lid", userID, key, 0, master)
 	default:
 		//todo
 	}
 	return nil
 }
  
-func updateFriendsInfoOfDB(vt, tablename, opt string, userID, value uint64) {
+//返回users中关注了userID的用户，每次按主键查询FilterFansBatch个
+func filterFansOfDB(userID uint64, users []uint64) ([]uint64, error) {
+	fans := make([]uint64, 0)
+	client := mysqlPool.GetClient(false)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return fans, ErrAllMysqlDown
+	}
+	for begin := 0; begin < len(users); begin += FilterFansBatch {
+		end := begin + FilterFansBatch
+		if end > len(users) {
+			end = len(users)
+		}
+		args := make([]interface{}, 0, end-begin+1)
+		args = append(args, userID)
+		for _, user := range users[begin:end] {
+			args = append(args, user)
+		}
+		rows, err := client.Query("select fid from fanslist where uid=? and fid in (?"+strings.Repeat(",?", end-begin-1)+")", args...)
+		if err != nil {
+			mpLogger.Warn(err)
+			return fans, err
+		}
+		for rows.Next() {
+			var fid uint64
+			if err := rows.Scan(&fid); err == nil {
+				fans = append(fans, fid)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fans, err
+		}
+	}
+	return fans, nil
+}
+
+func updateFriendsInfoOfDB(vt, tablename, opt string, userID, value uint64) error {
 	client := mysqlPool.GetClient(true)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
-		return
+		return ErrAllMysqlDown
 	}
 	switch opt {
 	case "add":
-		if _, err := client.Exec("insert into "+tablename+"(uid, "+vt+" ,ts) values(?,?,now())", userID, value); err != nil {
+		if _, err := client.Exec("insert into "+tablename+"(uid, "+vt+" ,ts) values(?,?,now()) on duplicate key update ts=ts", userID, value); err != nil {
 			mpLogger.Warn(err)
-			return
+			return classifyDBError(err)
 		}
 	case "delete":
 		if _, err := client.Exec("delete from "+tablename+" where uid=? and "+vt+"=?", userID, value); err != nil {
 			mpLogger.Warn(err)
-			return
+			return classifyDBError(err)
 		}
 		//附加操作（删除pushtimeline里对方的内容）
-		delPushFriendsTimeline(userID, value)
+		return delPushFriendsTimeline(userID, value)
 	default:
 		//do nothing
 	}
+	return nil
 }
 
-func getPersonalTimelineKeyFromDB(uid, tb, te uint64, key string) Timelines {
+//读取失败时返回error，不回写cache
+func getPersonalTimelineKeyFromDB(uid, tb, te uint64, key string, master bool) (Timelines, error) {
 
 	var (
 		valuekey string
@@ -90,26 +159,26 @@ func getPersonalTimelineKeyFromDB(uid, tb, te uint64, key string) Timelines {
 		err error
 	)
 	timelinekeys := make(Timelines, 0) 
-	client := mysqlPool.GetClient(false)
+	client := mysqlPool.GetClient(master)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
-		return timelinekeys
+		return timelinekeys, ErrAllMysqlDown
 	}
 	switch hash(uid) {
 	case 0:
 		rows, err = client.Query("select valuekey, ts from personaltimeline1 where uid=? and ts > ? and ts < ?", uid, tb, te)
 	case 1:
-		rows, err = client.Query("select valuekey, ts from personaltimeline1 where uid=? and ts > ? and ts < ?", uid, tb, te)
+		rows, err = client.Query("select valuekey, ts from personaltimeline2 where uid=? and ts > ? and ts < ?", uid, tb, te)
 	}
 	switch err {
 		case sql.ErrNoRows:
 			//回写脏数据
-			storageProxy.Set(context.Background(), key, ErrorResult)
-			return timelinekeys
+			setCache(key, ErrorResult)
+			return timelinekeys, nil
 		case nil:
 		default :
 			mpLogger.Warn(err)
-			return timelinekeys 
+			return timelinekeys, err
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -124,66 +193,64 @@ func getPersonalTimelineKeyFromDB(uid, tb, te uint64, key string) Timelines {
 		timelinekey.ValueKey = valuekey
 		timelinekeys = append(timelinekeys, timelinekey)
 	}
-	//set cache
-	go func(timelinekeys Timelines, key string) {
-		if item, _, err := setItem(timelinekeys, 0); err == nil {
-			storageProxy.Set(context.Background(), key, item)
-		}
-	}(timelinekeys, key)
-	return timelinekeys
+	//由storageProxy.GetOrLoad回写cache
+	return timelinekeys, nil
 }
 
-func addPersonalTimelineOfDB(uid, ts uint64, valuekey string) {
+func addPersonalTimelineOfDB(uid, ts uint64, valuekey string) error {
 	client := mysqlPool.GetClient(true)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
-		return 
+		return ErrAllMysqlDown
 	}
 	switch hash(uid) {
 	case 0:
-		if _, err := client.Exec("insert into personaltimeline1(uid, ts, valuekey) values(?,?,?)", uid, ts, valuekey); err != nil {
+		if _, err := client.Exec("insert into personaltimeline1(uid, ts, valuekey) values(?,?,?) on duplicate key update ts=ts", uid, ts, valuekey); err != nil {
 			mpLogger.Warn(err)
-			return
+			return classifyDBError(err)
 		}
 	case 1:
-		if _, err := client.Exec("insert into personaltimeline2(uid, ts, valuekey) values(?,?,?)", uid, ts, valuekey); err != nil {
+		if _, err := client.Exec("insert into personaltimeline2(uid, ts, valuekey) values(?,?,?) on duplicate key update ts=ts", uid, ts, valuekey); err != nil {
 			mpLogger.Warn(err)
-			return
+			return classifyDBError(err)
 		}
 	}
 	//set cache
+	return nil
 }
 
-func deletePersonalTimelineOfDB(uid, ts uint64) {
+func deletePersonalTimelineOfDB(uid, ts uint64) error {
 	client := mysqlPool.GetClient(true)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
-		return 
+		return ErrAllMysqlDown
 	}
 	switch hash(uid) {
 	case 0:
 		if _, err := client.Exec("delete from personaltimeline1 where uid=? and ts=?", uid, ts); err != nil {
 			mpLogger.Warn(err)
-			return
+			return classifyDBError(err)
 		}
 	case 1:
 		if _, err := client.Exec("delete from personaltimeline2 where uid=? and ts=?", uid, ts); err != nil {
 			mpLogger.Warn(err)
-			return
+			return classifyDBError(err)
 		}
 	}
 	//set cache
+	return nil
 }
 
-func updatePersonalTimeline(uid, ts uint64, valuekey, opt string)  {
+func updatePersonalTimeline(uid, ts uint64, valuekey, opt string) error {
 	switch opt {
 	case "add":
-		addPersonalTimelineOfDB(uid, ts, valuekey)
+		return addPersonalTimelineOfDB(uid, ts, valuekey)
 	case "delete":
-		deletePersonalTimelineOfDB(uid, ts)
+		return deletePersonalTimelineOfDB(uid, ts)
 	default:
 		//do nothing
 	}
+	return nil
 }
 
 func getPushFriendsTimelineFromDB(userID, tb, te uint64, key string) (Timelines, error) {
@@ -203,7 +270,7 @@ func getPushFriendsTimelineFromDB(userID, tb, te uint64, key string) (Timelines,
 	switch err {
 		case sql.ErrNoRows:
 			//回写脏数据
-			storageProxy.Set(context.Background(), key, ErrorResult)
+			setCache(key, ErrorResult)
 			return timelinekeys, nil
 		case nil:
 		default :
@@ -223,98 +290,330 @@ func getPushFriendsTimelineFromDB(userID, tb, te uint64, key string) (Timelines,
 		timelinekey.ValueKey = valuekey
 		timelinekeys = append(timelinekeys, timelinekey)
 	}
-	//set cache
-	go func(timelinekeys Timelines, key string) {
-		if item, _, err := setItem(timelinekeys, 0); err == nil {
-			storageProxy.Set(context.Background(), key, item)
-		}
-	}(timelinekeys, key)
+	//由storageProxy.GetOrLoad回写cache
 	return timelinekeys, nil
 }
 
-func addPushFriendsTimeline(userID, likesID, ts uint64, valuekey string) {
+func addPushFriendsTimeline(userID, likesID, ts uint64, valuekey string) error {
 	client := mysqlPool.GetClient(true)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
-		return
+		return ErrAllMysqlDown
 	}
-	if _, err := client.Exec("insert into pushfriendstimeline(uid, lid, ts, valuekey) values(?,?,?,?)", userID, likesID, ts, valuekey); err != nil {
+	if _, err := client.Exec("insert into pushfriendstimeline(uid, lid, ts, valuekey) values(?,?,?,?) on duplicate key update ts=ts", userID, likesID, ts, valuekey); err != nil {
 		mpLogger.Warn(err)
-		return
+		return classifyDBError(err)
 	}
 	//set cache
+	return nil
 }
 
-func delPushFriendsTimeline(userID, likesID uint64) {
+func delPushFriendsTimeline(userID, likesID uint64) error {
 	client := mysqlPool.GetClient(true)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
-		return
+		return ErrAllMysqlDown
 	}
-	if _, err := client.Exec("delete from pushfriendstimeline where uid=?, lid=?", userID, likesID); err != nil {
+	if _, err := client.Exec("delete from pushfriendstimeline where uid=? and lid=?", userID, likesID); err != nil {
 		mpLogger.Warn(err)
-		return
+		return classifyDBError(err)
 	}
 	//set cache
+	return nil
 }
 
-func addValueToDB(valueKey, value string) {
+func addValueToDB(valueKey, value string) error {
 	client := mysqlPool.GetClient(true)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
-		return 
+		return ErrAllMysqlDown
 	}
-	_, err := client.Exec("insert into valuestore(valuekey, value) values(?,?)", valueKey, value)
+	_, err := client.Exec("insert into valuestore(valuekey, value) values(?,?) on duplicate key update value=values(value)", valueKey, value)
 	if err != nil {
 		mpLogger.Warn(err)
-		return 
+		return classifyDBError(err)
 	}
 	//set cache
-
+	return nil
 }
 
-func delValueFromDB(value string) {
+func delValueFromDB(value string) error {
 	client := mysqlPool.GetClient(true)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
+		return ErrAllMysqlDown
 	}
 	_, err := client.Exec("delete from valuestore where value=?", value)
 	if err != nil {
 		mpLogger.Warn(err)
+		return classifyDBError(err)
 	}
 	//set cache
+	return nil
 }
 
-func getValueFromDB(valueKey string) string {
-	var value string
-	client := mysqlPool.GetClient(false)
+//写入一条通知，重复的通知不再写入，返回已有通知的id，inserted为false
+func addNotificationOfDB(uid, actor, ts uint64, notifyType, target, content, gkey, dkey string) (id uint64, inserted bool, err error) {
+	client := mysqlPool.GetClient(true)
 	if client == nil {
 		mpLogger.Error(ErrAllMysqlDown)
-		return value
+		return 0, false, ErrAllMysqlDown
 	}
-	rows, err := client.Query("select value from valuestore where valuekey=?", valueKey)
-	switch err {
-		case sql.ErrNoRows:
-			//回写脏数据
-			storageProxy.Set(context.Background(), valueKey, ErrorResult)
-			return value
-		case nil:
-		default :
+	rs, err := client.Exec("insert ignore into notification(uid, type, actor, target, gkey, dkey, content, ts) values(?,?,?,?,?,?,?,?)",
+		uid, notifyType, actor, target, gkey, dkey, content, ts)
+	if err != nil {
+		mpLogger.Warn(err)
+		return 0, false, classifyDBError(err)
+	}
+	n, err := rs.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	if n == 0 {
+		err = client.QueryRow("select id from notification where uid=? and type=? and actor=? and dkey=?",
+			uid, notifyType, actor, dkey).Scan(&id)
+		if err != nil {
 			mpLogger.Warn(err)
-			return value 
+			return 0, false, classifyDBError(err)
+		}
+		return id, false, nil
+	}
+	lastID, err := rs.LastInsertId()
+	return uint64(lastID), true, err
+}
+
+//按组读取通知，组内的用户按时间倒序取前NotifyActorsNum个
+func getNotificationsFromDB(uid, before uint64, limit int, key string) ([]*NotificationGroup, error) {
+	var (
+		actors string
+		rows   *sql.Rows
+		err    error
+	)
+	groups := make([]*NotificationGroup, 0)
+	client := mysqlPool.GetClient(false)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return groups, ErrAllMysqlDown
+	}
+	query := "select max(id), type, target, group_concat(actor order by id desc), count(distinct actor), max(ts), max(content) " +
+		"from notification where uid=? group by type, gkey "
+	if before > 0 {
+		rows, err = client.Query(query+"having max(id) < ? order by max(id) desc limit ?", uid, before, limit)
+	} else {
+		rows, err = client.Query(query+"order by max(id) desc limit ?", uid, limit)
+	}
+	if err != nil {
+		mpLogger.Warn(err)
+		return groups, err
 	}
 	defer rows.Close()
-	if rows.Next() {
-		err = rows.Scan(&value)
+
+	for rows.Next() {
+		group := &NotificationGroup{Actors: make([]uint64, 0, NotifyActorsNum)}
+		err = rows.Scan(&group.ID, &group.Type, &group.Target, &actors, &group.Count, &group.Timestamp, &group.Content)
 		if err != nil {
 			mpLogger.Warn(err)
+			continue
 		}
+		group.Actors = parseActors(actors, NotifyActorsNum)
+		groups = append(groups, group)
 	}
 	//set cache
-	go func(value, key string) {
-		if item, _, err := setItem(value, 0); err == nil {
-			storageProxy.Set(context.Background(), key, item)
+	go func(groups []*NotificationGroup, key string) {
+		if item, _, err := setItem(groups, 0); err == nil {
+			setCache(key, item)
+		}
+	}(groups, key)
+	return groups, nil
+}
+
+func addDeadLetterOfDB(dl *DeadLetter) error {
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return ErrAllMysqlDown
+	}
+	_, err := client.Exec("insert into deadletter(topic, msgkey, value, partitionid, msgoffset, error, attempts, ts) values(?,?,?,?,?,?,?,?)",
+		dl.Topic, dl.Key, dl.Value, dl.Partition, dl.Offset, dl.Error, dl.Attempts, dl.Timestamp)
+	if err != nil {
+		mpLogger.Warn(err)
+		return classifyDBError(err)
+	}
+	return nil
+}
+
+//按id倒序分页读取死信，topic为空时读取所有topic
+func getDeadLettersFromDB(topic string, before uint64, limit int) ([]*DeadLetter, error) {
+	dls := make([]*DeadLetter, 0)
+	client := mysqlPool.GetClient(false)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return dls, ErrAllMysqlDown
+	}
+	query := "select id, topic, msgkey, value, partitionid, msgoffset, error, attempts, ts from deadletter where 1=1"
+	args := make([]interface{}, 0, 3)
+	if topic != "" {
+		query += " and topic=?"
+		args = append(args, topic)
+	}
+	if before > 0 {
+		query += " and id<?"
+		args = append(args, before)
+	}
+	query += " order by id desc limit ?"
+	args = append(args, limit)
+	rows, err := client.Query(query, args...)
+	if err != nil {
+		mpLogger.Warn(err)
+		return dls, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		dl := new(DeadLetter)
+		if err := rows.Scan(&dl.ID, &dl.Topic, &dl.Key, &dl.Value, &dl.Partition, &dl.Offset,
+			&dl.Error, &dl.Attempts, &dl.Timestamp); err != nil {
+			return dls, err
+		}
+		dls = append(dls, dl)
+	}
+	return dls, rows.Err()
+}
+
+func getDeadLetterFromDB(id uint64) (*DeadLetter, error) {
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return nil, ErrAllMysqlDown
+	}
+	dl := new(DeadLetter)
+	err := client.QueryRow("select id, topic, msgkey, value, partitionid, msgoffset, error, attempts, ts from deadletter where id=?", id).
+		Scan(&dl.ID, &dl.Topic, &dl.Key, &dl.Value, &dl.Partition, &dl.Offset, &dl.Error, &dl.Attempts, &dl.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeadLetter
+	}
+	if err != nil {
+		mpLogger.Warn(err)
+		return nil, err
+	}
+	return dl, nil
+}
+
+func delDeadLetterOfDB(id uint64) error {
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return ErrAllMysqlDown
+	}
+	rs, err := client.Exec("delete from deadletter where id=?", id)
+	if err != nil {
+		mpLogger.Warn(err)
+		return err
+	}
+	if n, err := rs.RowsAffected(); err == nil && n == 0 {
+		return ErrDeadLetter
+	}
+	return nil
+}
+
+//按id顺序读取未发送的outbox事件
+func getOutboxFromDB(limit int) ([]*OutboxEvent, error) {
+	events := make([]*OutboxEvent, 0)
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return events, ErrAllMysqlDown
+	}
+	rows, err := client.Query("select id, topic, msgkey, value, attempts, retry_at from outbox where sent=0 order by id limit ?", limit)
+	if err != nil {
+		mpLogger.Warn(err)
+		return events, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := new(OutboxEvent)
+		if err := rows.Scan(&e.ID, &e.Topic, &e.Key, &e.Value, &e.Attempts, &e.RetryAt); err != nil {
+			return events, err
 		}
-	}(value, valueKey)
-	return value
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func markOutboxSentOfDB(ids []uint64) error {
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return ErrAllMysqlDown
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	query := "update outbox set sent=1 where id in (?" + strings.Repeat(",?", len(ids)-1) + ")"
+	if _, err := client.Exec(query, args...); err != nil {
+		mpLogger.Warn(err)
+		return err
+	}
+	return nil
+}
+
+//记录一次发送失败，park为true时搁置
+func failOutboxOfDB(id uint64, retryAt int64, park bool) error {
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return ErrAllMysqlDown
+	}
+	sent := OutboxPending
+	if park {
+		sent = OutboxParked
+	}
+	if _, err := client.Exec("update outbox set attempts=attempts+1, retry_at=?, sent=? where id=? and sent=0", retryAt, sent, id); err != nil {
+		mpLogger.Warn(err)
+		return err
+	}
+	return nil
+}
+
+//将搁置的事件放回，返回放回的条数
+func requeueOutboxOfDB() (int64, error) {
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return 0, ErrAllMysqlDown
+	}
+	rs, err := client.Exec("update outbox set sent=?, attempts=0, retry_at=0 where sent=?", OutboxPending, OutboxParked)
+	if err != nil {
+		mpLogger.Warn(err)
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+//删除ts之前已发送的事件，返回删除的条数
+func purgeOutboxOfDB(before int64, limit int) (int64, error) {
+	client := mysqlPool.GetClient(true)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return 0, ErrAllMysqlDown
+	}
+	rs, err := client.Exec("delete from outbox where sent=1 and ts<? limit ?", before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+func countOutboxOfDB(sent int) (int64, error) {
+	client := mysqlPool.GetClient(false)
+	if client == nil {
+		mpLogger.Error(ErrAllMysqlDown)
+		return 0, ErrAllMysqlDown
+	}
+	var n int64
+	if err := client.QueryRow("select count(*) from outbox where sent=?", sent).Scan(&n); err != nil {
+		mpLogger.Warn(err)
+		return 0, err
+	}
+	return n, nil
 }
@@ -0,0 +1,89 @@
+package mpsrc
+
+import (
+	"feed/mq"
+	"time"
+)
+
+/*
+* 死信：consumer写入失败时，可重试的错误（mysql不可用、超时等）按[retry]的配置指数退避原地重试，
+* 不可重试的错误（消息格式错误、数据不合法等）或者重试耗尽后，原始消息连同错误放入DEADLETTER队列，
+* 由DEADLETTER的consumer写入mysql的deadletter表，admin可以查看、重放（放回原topic）或者丢弃；
+* 写入deadletter表可重试的失败不提交offset，死信一直留在DEADLETTER队列中重新投递，直到写入成功
+ */
+type DeadLetter struct {
+	ID        uint64 `json:"id"`
+	Topic     string `json:"topic"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Error     string `json:"error"`
+	Attempts  int    `json:"attempts"`
+	Timestamp int64  `json:"timestamp"` // 放入死信队列的时间(s)
+}
+
+//死信只有信封格式
+func (d *DeadLetter) decodeLegacy(key, value string, env *Envelope) error {
+	return ErrEvent
+}
+
+func retryPolicy() *mq.RetryPolicy {
+	return &mq.RetryPolicy{
+		MaxAttempts:    config.Retry.MaxAttempts,
+		InitialBackoff: config.Retry.InitialBackoff,
+		MaxBackoff:     config.Retry.MaxBackoff,
+	}
+}
+
+//将失败的消息同步放入死信队列，确认后原消息才提交，放入失败时返回错误，由OnError记录
+func deadLetter(msg *mq.Message, err error, attempts int) error {
+	mpLogger.Error(err, msg.Topic, string(msg.Key), attempts)
+	_, perr := sendEvent(DEADLETTER, string(msg.Key), &DeadLetter{
+		Topic:     msg.Topic,
+		Key:       string(msg.Key),
+		Value:     string(msg.Value),
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Error:     err.Error(),
+		Attempts:  attempts,
+		Timestamp: time.Now().Unix(),
+	}, time.Now(), Trace{}, true)
+	return perr
+}
+
+//死信本身只在不可重试的错误（格式错误、数据不合法）时丢弃并记录完整的消息，其余的错误返回，不提交offset
+func keepDeadLetter(handler mq.Handler) mq.Handler {
+	return func(msg *mq.Message) error {
+		err := handler(msg)
+		if err != nil && mq.IsPermanent(err) {
+			mpLogger.Error(mq.Cause(err), msg.Topic, string(msg.Key), string(msg.Value))
+			return nil
+		}
+		return err
+	}
+}
+
+//死信的消费：写入mysql
+func handleDeadLetter(msg *mq.Message) error {
+	var dl DeadLetter
+	if _, err := decodeEvent(msg, &dl); err != nil {
+		return err
+	}
+	return addDeadLetterOfDB(&dl)
+}
+
+//重放死信：按原来的topic和key放回队列，成功后删除
+func replayDeadLetter(id uint64) error {
+	dl, err := getDeadLetterFromDB(id)
+	if err != nil {
+		return err
+	}
+	if _, ok := topicHandlers[dl.Topic]; !ok {
+		return ErrTopic
+	}
+	if err := publishSync(dl.Topic, dl.Key, dl.Value); err != nil {
+		return err
+	}
+	return delDeadLetterOfDB(id)
+}
@@ -0,0 +1,22 @@
+package mpsrc
+
+import (
+	"feed/mq"
+	"testing"
+)
+
+func TestKeepDeadLetter(t *testing.T) {
+	//可重试的错误不丢弃，返回后不提交offset
+	handler := keepDeadLetter(func(msg *mq.Message) error {
+		return ErrAllMysqlDown
+	})
+	if err := handler(&mq.Message{Topic: DEADLETTER}); err != ErrAllMysqlDown {
+		t.Errorf("expected: %v, got: %v", ErrAllMysqlDown, err)
+	}
+	handler = keepDeadLetter(func(msg *mq.Message) error {
+		return nil
+	})
+	if err := handler(&mq.Message{Topic: DEADLETTER}); err != nil {
+		t.Errorf("expected: nil, got: %v", err)
+	}
+}
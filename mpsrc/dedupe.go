@@ -0,0 +1,165 @@
+package mpsrc
+
+import (
+	"encoding/json"
+	"feed/mq"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+/*
+* 消费的幂等：按事件id（旧格式的消息按topic、分区和offset）在redis中记录处理状态，
+* 处理前以SET NX占用一个租约，成功后标记为已处理并保留[dedupe]的Window，失败时释放租约以便重试；
+* 已处理的事件直接跳过，正在被其他consumer处理的事件（比如重新平衡期间）返回可重试的错误；
+* 失败的事件不会标记为已处理，所以重放死信（事件id不变）可以正常处理。
+* 同时mysql的写入都是upsert，redis不可用时不去重，仍然处理
+ */
+const (
+	eventProcessing = "processing"
+	eventDone       = "done"
+
+	//claimEvents返回的每个事件的状态
+	eventClaimed = 1
+	eventSkipped = 0  //已经处理过
+	eventBusy    = -1 //正在被其他consumer处理
+)
+
+//KEYS: 事件的去重key；ARGV: 处理中的状态,租约时间(ms),已处理的状态
+var claimEventsScript = redis.NewScript(-1, `
+local states = {}
+for i = 1, #KEYS do
+	if redis.call('SET', KEYS[i], ARGV[1], 'PX', ARGV[2], 'NX') then
+		states[i] = 1
+	elseif redis.call('GET', KEYS[i]) == ARGV[3] then
+		states[i] = 0
+	else
+		states[i] = -1
+	end
+end
+return states`)
+
+//事件的去重key
+func eventKey(msg *mq.Message) string {
+	var env struct {
+		ID string `json:"id"`
+	}
+	if len(msg.Value) > 0 && msg.Value[0] == '{' && json.Unmarshal(msg.Value, &env) == nil && env.ID != "" {
+		return PROCESSED + msg.Topic + ":" + env.ID
+	}
+	return PROCESSED + msg.Topic + ":" + strconv.Itoa(int(msg.Partition)) + ":" + strconv.FormatInt(msg.Offset, 10)
+}
+
+//一次占用一批事件的租约，返回每个事件的状态
+func claimEvents(keys []string, lease time.Duration) ([]int, error) {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return nil, ErrNilRedisConn
+	}
+	defer conn.Close()
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(eventProcessing, int64(lease/time.Millisecond), eventDone)
+	return redis.Ints(claimEventsScript.Do(conn, args...))
+}
+
+//占用事件的租约，返回false表示已经处理过
+func claimEvent(key string, lease time.Duration) (bool, error) {
+	states, err := claimEvents([]string{key}, lease)
+	if err != nil {
+		return false, err
+	}
+	switch states[0] {
+	case eventClaimed:
+		return true, nil
+	case eventSkipped:
+		return false, nil
+	}
+	return false, ErrEventInProgress
+}
+
+//处理成功时标记为已处理，失败时释放租约，一批事件用pipeline一次提交
+func finishEvents(keys []string, ok bool, window time.Duration) {
+	if len(keys) == 0 {
+		return
+	}
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		mpLogger.Error(ErrNilRedisConn, keys)
+		return
+	}
+	defer conn.Close()
+	for _, key := range keys {
+		if ok {
+			conn.Send("SET", key, eventDone, "EX", int64(window/time.Second))
+		} else {
+			conn.Send("DEL", key)
+		}
+	}
+	if _, err := conn.Do(""); err != nil {
+		mpLogger.Error(err, keys)
+	}
+}
+
+func finishEvent(key string, ok bool, window time.Duration) {
+	finishEvents([]string{key}, ok, window)
+}
+
+func dedupe(handler mq.Handler, dc *DedupeConfig) mq.Handler {
+	return func(msg *mq.Message) error {
+		key := eventKey(msg)
+		claimed, err := claimEvent(key, dc.Lease)
+		if err == ErrEventInProgress {
+			return err
+		}
+		if err != nil {
+			mpLogger.Error(err, key)
+			return handler(msg)
+		}
+		if !claimed {
+			return nil
+		}
+		err = handler(msg)
+		finishEvent(key, err == nil, dc.Window)
+		return err
+	}
+}
+
+/*
+* 批量处理的去重：一次脚本占用整批事件，跳过已经处理过的事件，其余的整批处理后用pipeline一起标记；
+* 有事件正在被其他consumer处理时，其余的事件处理后返回可重试的错误，重试时已处理的会被跳过
+ */
+func dedupeBatch(handler mq.BatchHandler, dc *DedupeConfig) mq.BatchHandler {
+	return func(msgs []*mq.Message) error {
+		var (
+			pending []*mq.Message
+			claimed []string
+			busy    bool
+		)
+		keys := make([]string, len(msgs))
+		for i, msg := range msgs {
+			keys[i] = eventKey(msg)
+		}
+		states, err := claimEvents(keys, dc.Lease)
+		if err != nil {
+			//redis不可用时不去重
+			mpLogger.Error(err, len(keys))
+			return handler(msgs)
+		}
+		for i, msg := range msgs {
+			switch states[i] {
+			case eventClaimed:
+				pending = append(pending, msg)
+				claimed = append(claimed, keys[i])
+			case eventBusy:
+				busy = true
+			}
+		}
+		if len(pending) > 0 {
+			err = handler(pending)
+		}
+		finishEvents(claimed, err == nil, dc.Window)
+		if err == nil && busy {
+			return ErrEventInProgress
+		}
+		return err
+	}
+}
@@ -0,0 +1,26 @@
+package mpsrc
+
+import (
+	"feed/mq"
+	"testing"
+	"time"
+)
+
+func TestEventKey(t *testing.T) {
+	env, value, err := newEnvelope(ADDFANS, &RelationEvent{UserID: 1, TargetID: 2}, time.Now(), Trace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//同一个事件重新投递到其他offset时key不变
+	for _, offset := range []int64{1, 2} {
+		key := eventKey(&mq.Message{Topic: ADDFANS, Value: value, Offset: offset})
+		if key != PROCESSED+ADDFANS+":"+env.ID {
+			t.Errorf("expected: %v, got: %v", PROCESSED+ADDFANS+":"+env.ID, key)
+		}
+	}
+	//旧格式按分区和offset去重
+	key := eventKey(&mq.Message{Topic: ADDFANS, Value: []byte("2"), Partition: 3, Offset: 5})
+	if key != PROCESSED+ADDFANS+":3:5" {
+		t.Errorf("expected: %v, got: %v", PROCESSED+ADDFANS+":3:5", key)
+	}
+}
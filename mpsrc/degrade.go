@@ -0,0 +1,185 @@
+package mpsrc
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+* 写入过载时的自适应降级：定期检查producer和consumer的积压，超过阈值后
+* 新发布的动态不再push给粉丝，只记录作者在该时间点有只能pull的动态，
+* 积压回落到阈值*RecoverRatio以下并保持HoldTime后恢复push；
+* 全局的PullOnlyWindow记录只能pull的动态最早和最晚的时间，读取好友动态的时间段
+* 与之不重叠时（绝大多数时间没有降级）不需要逐个检查关注对象
+ */
+const (
+	ModePush     = "push"
+	ModePullOnly = "pullonly"
+)
+
+type DegradeStats struct {
+	Mode            string `json:"mode"`
+	Since           int64  `json:"since"`
+	Transitions     uint64 `json:"transitions"`
+	DegradedPosts   uint64 `json:"degraded_posts"`
+	ProducerBacklog int64  `json:"producer_backlog"`
+	ConsumerBacklog int64  `json:"consumer_backlog"`
+	Reason          string `json:"reason"`
+}
+
+var (
+	pullOnly      int32
+	degradedPosts uint64
+	degradeMu     sync.Mutex
+	degradeStats  = DegradeStats{Mode: ModePush}
+
+	//KEYS: 全局窗口；ARGV: 动态时间,过期时间
+	pullOnlyWindowScript = redis.NewScript(1, `
+local ts = tonumber(ARGV[1])
+local since = tonumber(redis.call('HGET', KEYS[1], 'since') or '0')
+if since == 0 or ts < since then
+	redis.call('HSET', KEYS[1], 'since', ts)
+end
+if ts > tonumber(redis.call('HGET', KEYS[1], 'last') or '0') then
+	redis.call('HSET', KEYS[1], 'last', ts)
+end
+return redis.call('EXPIRE', KEYS[1], ARGV[2])`)
+)
+
+func isPullOnly() bool {
+	return atomic.LoadInt32(&pullOnly) == 1
+}
+
+func getDegradeStats() DegradeStats {
+	degradeMu.Lock()
+	defer degradeMu.Unlock()
+	stats := degradeStats
+	stats.DegradedPosts = atomic.LoadUint64(&degradedPosts)
+	return stats
+}
+
+func switchMode(mode, reason string) {
+	degradeMu.Lock()
+	degradeStats.Mode = mode
+	degradeStats.Since = time.Now().Unix()
+	degradeStats.Transitions++
+	degradeStats.Reason = reason
+	degradeMu.Unlock()
+
+	if mode == ModePullOnly {
+		atomic.StoreInt32(&pullOnly, 1)
+		mpLogger.Warn("push degraded to pull-only: ", reason)
+	} else {
+		atomic.StoreInt32(&pullOnly, 0)
+		mpLogger.Info("push recovered: ", reason)
+	}
+}
+
+//根据当前积压决定是否需要切换模式
+func checkBacklog(dc *DegradeConfig) {
+	stats := getLagStats()
+	producerBacklog := stats[StageProducer].Backlog
+	consumerBacklog := stats[StageConsumer].Backlog
+	reason := "producer backlog " + strconv.FormatInt(producerBacklog, 10) +
+		", consumer backlog " + strconv.FormatInt(consumerBacklog, 10)
+
+	degradeMu.Lock()
+	degradeStats.ProducerBacklog = producerBacklog
+	degradeStats.ConsumerBacklog = consumerBacklog
+	since := degradeStats.Since
+	degradeMu.Unlock()
+
+	if !isPullOnly() {
+		if producerBacklog > dc.ProducerBacklog || consumerBacklog > dc.ConsumerBacklog {
+			switchMode(ModePullOnly, reason)
+		}
+		return
+	}
+	if time.Since(time.Unix(since, 0)) < dc.HoldTime {
+		return
+	}
+	if float64(producerBacklog) < float64(dc.ProducerBacklog)*dc.RecoverRatio &&
+		float64(consumerBacklog) < float64(dc.ConsumerBacklog)*dc.RecoverRatio {
+		switchMode(ModePush, reason)
+	}
+}
+
+func watchBacklog(dc *DegradeConfig) {
+	ticker := time.NewTicker(dc.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkBacklog(dc)
+	}
+}
+
+//记录作者在ts时刻发布了一条没有push的动态，读取好友动态时需要主动pull该作者
+func markPullOnly(userID, ts string) {
+	atomic.AddUint64(&degradedPosts, 1)
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		mpLogger.Error(ErrNilRedisConn)
+		return
+	}
+	defer conn.Close()
+	key := userID + PULLONLY
+	conn.Send("ZADD", key, ts, ts)
+	conn.Send("EXPIRE", key, PullOnlyExpireTime)
+	pullOnlyWindowScript.Send(conn, PULLONLYWINDOW, ts, PullOnlyExpireTime)
+	if _, err := conn.Do(""); err != nil {
+		mpLogger.Error(err, key)
+	}
+}
+
+//时间段(begin, end)与只能pull的动态的时间范围[since, last]是否重叠，since为0表示没有降级过
+func overlapsPullOnly(since, last, begin, end uint64) bool {
+	return since > 0 && last > begin && since < end
+}
+
+//返回在时间段内有只能pull的动态的关注对象
+func getPullOnlyAuthors(ids []uint64, timestampBegin, timestampEnd string) map[uint64]bool {
+	authors := make(map[uint64]bool)
+	if len(ids) == 0 {
+		return authors
+	}
+	conn := redisPool.GetClient(false)
+	if conn == nil {
+		mpLogger.Error(ErrNilRedisConn)
+		return authors
+	}
+	defer conn.Close()
+	//没有降级的时间段内不需要逐个检查
+	window, err := redis.Values(conn.Do("HMGET", PULLONLYWINDOW, "since", "last"))
+	if err != nil {
+		mpLogger.Error(err)
+		return authors
+	}
+	var since, last uint64
+	redis.Scan(window, &since, &last)
+	begin, _ := strconv.ParseUint(timestampBegin, 10, 64)
+	end, err := strconv.ParseUint(timestampEnd, 10, 64)
+	if err != nil {
+		end = math.MaxUint64
+	}
+	if !overlapsPullOnly(since, last, begin, end) {
+		return authors
+	}
+	for _, id := range ids {
+		conn.Send("ZCOUNT", strconv.FormatUint(id, 10)+PULLONLY, "("+timestampBegin, "("+timestampEnd)
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		mpLogger.Error(err)
+		return authors
+	}
+	for i, reply := range replies {
+		if n, err := redis.Int(reply, nil); err == nil && n > 0 {
+			authors[ids[i]] = true
+		}
+	}
+	return authors
+}
@@ -0,0 +1,25 @@
+package mpsrc
+
+import (
+	"testing"
+)
+
+func TestOverlapsPullOnly(t *testing.T) {
+	cases := []struct {
+		since, last, begin, end uint64
+		expected                bool
+	}{
+		{0, 0, 100, 200, false},     //没有降级过
+		{100, 150, 120, 200, true},  //窗口与时间段相交
+		{100, 150, 50, 100, false},  //时间段不含end
+		{100, 150, 150, 200, false}, //时间段不含begin
+		{100, 150, 99, 101, true},
+		{120, 130, 100, 200, true},
+		{100, 300, 150, 200, true},
+	}
+	for _, c := range cases {
+		if got := overlapsPullOnly(c.since, c.last, c.begin, c.end); got != c.expected {
+			t.Errorf("overlapsPullOnly(%v, %v, %v, %v) expected: %v, got: %v", c.since, c.last, c.begin, c.end, c.expected, got)
+		}
+	}
+}
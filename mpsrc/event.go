@@ -0,0 +1,311 @@
+package mpsrc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"feed/mq"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* 队列中的事件：统一封装成带版本号的JSON信封，payload的结构由事件类型（即topic）决定；
+* 解码时忽略不认识的字段，新版本的信封按已知字段尽量解析，
+* 不是信封的消息按旧的逗号分隔格式解析，所以升级时先升级consumer，再升级producer
+ */
+const (
+	EventVersion = 1
+)
+
+//同一次用户操作产生的事件共享TraceID，ParentID为直接触发本事件的事件id
+type Trace struct {
+	TraceID  string `json:"trace_id"`
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+type Envelope struct {
+	Version   int             `json:"v"`
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Timestamp int64           `json:"ts"` // 发布时间，纳秒
+	Trace     Trace           `json:"trace"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+//ADDFANS、DELFANS时TargetID为粉丝，ADDLIKES、DELLIKES时为被关注的用户
+type RelationEvent struct {
+	UserID   uint64 `json:"user_id"`
+	TargetID uint64 `json:"target_id"`
+}
+
+//FRIENDSTIMELINE：将作者的动态写入粉丝UserID的inbox
+type PushEvent struct {
+	UserID    uint64 `json:"user_id"`
+	Author    uint64 `json:"author"`
+	Timestamp uint64 `json:"timestamp"`
+	ValueKey  string `json:"value_key"`
+}
+
+//ADDPERSONALTIMELINE、DELPERSONALTIMELINE，删除时没有ValueKey
+type TimelineEvent struct {
+	UserID    uint64 `json:"user_id"`
+	Timestamp uint64 `json:"timestamp"`
+	ValueKey  string `json:"value_key,omitempty"`
+}
+
+//ADDVALUE、DELVALUE，删除时没有Value
+type ValueEvent struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+//UNREAD：Op为increase或decrease，Type为动态时没有Receiver
+type UnreadChangeEvent struct {
+	Op        string `json:"op"`
+	Author    uint64 `json:"author"`
+	Timestamp uint64 `json:"timestamp"`
+	Type      string `json:"type"`
+	Receiver  uint64 `json:"receiver,omitempty"`
+}
+
+//NOTIFICATION
+type NotificationEvent struct {
+	Receiver  uint64 `json:"receiver"`
+	Type      string `json:"type"`
+	Actor     uint64 `json:"actor"`
+	Target    string `json:"target,omitempty"`
+	Timestamp uint64 `json:"timestamp"`
+	Content   string `json:"content,omitempty"`
+}
+
+//旧格式的消息：key为消息的key，value为逗号分隔的内容，带发布时间的消息设置env.Timestamp
+type legacyEvent interface {
+	decodeLegacy(key, value string, env *Envelope) error
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//派生事件的trace
+func (e *Envelope) child() Trace {
+	return Trace{TraceID: e.Trace.TraceID, ParentID: e.ID}
+}
+
+func (e *Envelope) publishedAt() time.Time {
+	if e.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, e.Timestamp)
+}
+
+//封装事件，trace为空时作为一次新操作的第一个事件
+func newEnvelope(eventType string, payload interface{}, publishedAt time.Time, trace Trace) (*Envelope, []byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	env := &Envelope{
+		Version:   EventVersion,
+		ID:        newEventID(),
+		Type:      eventType,
+		Timestamp: publishedAt.UnixNano(),
+		Trace:     trace,
+		Payload:   data,
+	}
+	if env.Trace.TraceID == "" {
+		env.Trace.TraceID = env.ID
+	}
+	value, err := json.Marshal(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	return env, value, nil
+}
+
+//封装事件并放入队列
+func publishEvent(topic, key string, payload interface{}, publishedAt time.Time, trace Trace) (*Envelope, error) {
+	return sendEvent(topic, key, payload, publishedAt, trace, false)
+}
+
+//关键的写入（关注关系、删除），配置了SyncPublish时等待kafka确认，返回的错误反映是否写入成功
+func publishCriticalEvent(topic, key string, payload interface{}, publishedAt time.Time, trace Trace) (*Envelope, error) {
+	return sendEvent(topic, key, payload, publishedAt, trace, config.Kafka.SyncPublish)
+}
+
+func sendEvent(topic, key string, payload interface{}, publishedAt time.Time, trace Trace, sync bool) (*Envelope, error) {
+	env, value, err := newEnvelope(topic, payload, publishedAt, trace)
+	if err != nil {
+		mpLogger.Error(err, topic, key)
+		return nil, err
+	}
+	if sync {
+		err = publishSync(topic, key, string(value))
+	} else {
+		err = publish(topic, key, string(value))
+	}
+	if err != nil {
+		mpLogger.Error(err, topic, key)
+		return env, err
+	}
+	return env, nil
+}
+
+//将事件放入队列，并记录入队时距发布时间的耗时
+func produceEvent(topic, key string, payload interface{}, publishedAt time.Time, trace Trace) (*Envelope, error) {
+	enterStage(StageProducer)
+	env, err := publishEvent(topic, key, payload, publishedAt, trace)
+	leaveStage(StageProducer)
+	observeLag(StageProducer, publishedAt)
+	return env, err
+}
+
+//解析消息中的事件到payload，兼容旧的逗号分隔格式，解析失败的消息不可重试
+func decodeEvent(msg *mq.Message, payload legacyEvent) (*Envelope, error) {
+	env := &Envelope{Type: msg.Topic}
+	if len(msg.Value) == 0 || msg.Value[0] != '{' {
+		if err := payload.decodeLegacy(string(msg.Key), string(msg.Value), env); err != nil {
+			return nil, mq.Permanent(err)
+		}
+		return env, nil
+	}
+	if err := json.Unmarshal(msg.Value, env); err != nil {
+		return nil, mq.Permanent(err)
+	}
+	if err := json.Unmarshal(env.Payload, payload); err != nil {
+		return nil, mq.Permanent(err)
+	}
+	return env, nil
+}
+
+func (e *RelationEvent) decodeLegacy(key, value string, env *Envelope) error {
+	userID, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	targetID, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	e.UserID, e.TargetID = userID, targetID
+	return nil
+}
+
+//旧格式中附在末尾的发布时间（纳秒），无法解析时为0
+func legacyPublishTime(field string) int64 {
+	ns, _ := strconv.ParseInt(field, 10, 64)
+	return ns
+}
+
+//value: 作者id,动态时间,valueKey[,发布时间]
+func (e *PushEvent) decodeLegacy(key, value string, env *Envelope) error {
+	fields := strings.Split(value, ",")
+	if len(fields) < 3 {
+		return ErrEvent
+	}
+	if len(fields) > 3 {
+		env.Timestamp = legacyPublishTime(fields[3])
+	}
+	userID, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	author, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	ts, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	e.UserID, e.Author, e.Timestamp, e.ValueKey = userID, author, ts, fields[2]
+	return nil
+}
+
+//value: 动态时间[,valueKey]
+func (e *TimelineEvent) decodeLegacy(key, value string, env *Envelope) error {
+	userID, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	fields := strings.SplitN(value, ",", 2)
+	ts, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	e.UserID, e.Timestamp = userID, ts
+	if len(fields) == 2 {
+		e.ValueKey = fields[1]
+	}
+	return nil
+}
+
+func (e *ValueEvent) decodeLegacy(key, value string, env *Envelope) error {
+	if key == "" {
+		return ErrEvent
+	}
+	e.Key, e.Value = key, value
+	return nil
+}
+
+/*
+* key为increase或decrease时，value: 作者id,动态时间[,类型,接收者id][,发布时间]
+* 否则key为用户id，value: increase或decrease,作者id,动态时间[,类型,接收者id][,发布时间]
+ */
+func (e *UnreadChangeEvent) decodeLegacy(key, value string, env *Envelope) error {
+	fields := strings.Split(value, ",")
+	if key != "increase" && key != "decrease" {
+		key, fields = fields[0], fields[1:]
+	}
+	if (key != "increase" && key != "decrease") || len(fields) < 2 {
+		return ErrEvent
+	}
+	//动态2个字段，提及和评论4个字段，多出的一个为发布时间
+	if len(fields) == 3 || len(fields) == 5 {
+		env.Timestamp = legacyPublishTime(fields[len(fields)-1])
+		fields = fields[:len(fields)-1]
+	}
+	author, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	ts, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	e.Op, e.Author, e.Timestamp, e.Type = key, author, ts, UnreadPost
+	if len(fields) >= 4 {
+		receiver, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return ErrEvent
+		}
+		e.Type, e.Receiver = fields[2], receiver
+	}
+	return nil
+}
+
+//value: 类型,发起者id,动态key,时间,内容
+func (e *NotificationEvent) decodeLegacy(key, value string, env *Envelope) error {
+	receiver, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	fields := strings.SplitN(value, ",", 5)
+	if len(fields) < 5 {
+		return ErrEvent
+	}
+	actor, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	ts, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return ErrEvent
+	}
+	e.Receiver, e.Type, e.Actor, e.Target, e.Timestamp, e.Content = receiver, fields[0], actor, fields[2], ts, fields[4]
+	return nil
+}
@@ -0,0 +1,78 @@
+package mpsrc
+
+import (
+	"feed/mq"
+	"testing"
+	"time"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	publishedAt := time.Unix(1473350400, 123)
+	env, value, err := newEnvelope(NOTIFICATION, &NotificationEvent{
+		Receiver:  2,
+		Type:      NotifyComment,
+		Actor:     1,
+		Target:    "abc",
+		Timestamp: 1473350400,
+		Content:   "a,b",
+	}, publishedAt, Trace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Trace.TraceID != env.ID {
+		t.Errorf("expected: %v, got: %v", env.ID, env.Trace.TraceID)
+	}
+
+	var event NotificationEvent
+	got, err := decodeEvent(&mq.Message{Topic: NOTIFICATION, Key: []byte("2"), Value: value}, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != env.ID || !got.publishedAt().Equal(publishedAt) || event.Content != "a,b" || event.Actor != 1 {
+		t.Errorf("Test decodeEvent failed, got %+v %+v", got, event)
+	}
+
+	//新版本的信封忽略不认识的字段
+	value = []byte(`{"v":2,"id":"x","type":"addfans","ts":1,"extra":true,"payload":{"user_id":1,"target_id":2,"extra":1}}`)
+	var relation RelationEvent
+	if _, err := decodeEvent(&mq.Message{Topic: ADDFANS, Value: value}, &relation); err != nil {
+		t.Fatal(err)
+	}
+	if relation.UserID != 1 || relation.TargetID != 2 {
+		t.Errorf("Test decodeEvent with newer version failed, got %+v", relation)
+	}
+}
+
+func TestDecodeLegacyEvent(t *testing.T) {
+	var push PushEvent
+	env, err := decodeEvent(&mq.Message{Key: []byte("2"), Value: []byte("1,1473350400,abc,123")}, &push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if push.UserID != 2 || push.Author != 1 || push.Timestamp != 1473350400 || push.ValueKey != "abc" || env.Timestamp != 123 {
+		t.Errorf("Test decode legacy push failed, got %+v %+v", push, env)
+	}
+
+	cases := []struct {
+		key, value string
+		expected   UnreadChangeEvent
+	}{
+		{"increase", "1,1473350400", UnreadChangeEvent{Op: "increase", Author: 1, Timestamp: 1473350400, Type: UnreadPost}},
+		{"decrease", "1,1473350400,123", UnreadChangeEvent{Op: "decrease", Author: 1, Timestamp: 1473350400, Type: UnreadPost}},
+		{"2", "increase,1,1473350400,mention,2,123", UnreadChangeEvent{Op: "increase", Author: 1, Timestamp: 1473350400, Type: UnreadMention, Receiver: 2}},
+	}
+	for _, c := range cases {
+		var unread UnreadChangeEvent
+		if _, err := decodeEvent(&mq.Message{Key: []byte(c.key), Value: []byte(c.value)}, &unread); err != nil {
+			t.Fatal(err)
+		}
+		if unread != c.expected {
+			t.Errorf("expected: %+v, got: %+v", c.expected, unread)
+		}
+	}
+
+	var unread UnreadChangeEvent
+	if _, err := decodeEvent(&mq.Message{Key: []byte("2"), Value: []byte("1,1473350400")}, &unread); mq.Cause(err) != ErrEvent {
+		t.Errorf("expected: %v, got: %v", ErrEvent, err)
+	}
+}
@@ -25,6 +25,7 @@ var (
 	argsflag     = Flags{}
 	redisPool    *lib.RedisPool
 	mcStorage    *storage.MemcacheStorage
+	l1Storage    *storage.L1Storage
 	storageProxy storage.DefaultProxy
 	mysqlPool    *lib.MysqlPool
 	config       *TomlConfig
@@ -90,10 +91,75 @@ func setMysqlPool() {
 	}
 }
 
+func setupQueue() {
+	if err := setupMQ(); err != nil {
+		fmt.Println("Setup mq failed", err)
+		os.Exit(1)
+	}
+}
+
+//缓存未命中时由proxy读取mysql（valuestore）并回写缓存
 func setupStorageProxy() {
+	expiration := int64(DefaultExpireTime)
+	if config.Memcached.SetBackExpiration > 0 {
+		expiration = int64(config.Memcached.SetBackExpiration)
+	}
+	//进程内的L1缓存在memcache之前，只缓存动态内容（value），
+	//时间线、关注列表等会变化的key在其他实例更新后最多有TTL的延迟，不放入L1
+	var preferred storage.Storage = mcStorage
+	if config.L1.MaxBytes > 0 {
+		l1Storage = storage.NewL1Storage(mcStorage, storage.L1StorageOptions{
+			MaxBytes:  config.L1.MaxBytes,
+			TTL:       config.L1.TTL,
+			Cacheable: isValueKey,
+		})
+		preferred = l1Storage
+	}
 	storageProxy = storage.DefaultProxy{
-		PreferredStorage: mcStorage,
+		PreferredStorage: preferred,
+		BackupStorage: lib.NewMysqlStorage(mysqlPool, &lib.MysqlStorageOpts{
+			Table:       "valuestore",
+			KeyColumn:   "valuekey",
+			ValueColumn: "value",
+			LE: func(c context.Context, err error, v ...interface{}) {
+				mpLogger.Error(err, v)
+			},
+		}),
+		ReadThroughProcessor: storage.NewSetBackProcessor(expiration),
+		//value由consumer写入mysql，通过proxy写入时写mysql后删除缓存
+		WriteMode: storage.WriteAround,
+	}
+	//缓存未命中时合并同一个key的DB查询
+	storageProxy.EnableCoalescing(config.Coalesce.RefreshAhead)
+}
+
+//未配置任何保留策略时不启动清理任务
+func setupRetention() {
+	if config.Retention.MaxCount == 0 && config.Retention.MaxAge == 0 {
+		mpLogger.Info("retention is disabled")
+		return
+	}
+	go runRetention(&config.Retention)
+}
+
+//根据积压在push和只pull之间自动切换
+func setupDegrade() {
+	go watchBacklog(&config.Degrade)
+}
+
+//实时通知的hub，订阅其他实例广播的事件，定期丢弃断开过久的用户
+func setupNotify() {
+	hub = newNotifyHub(config.Notify.Backlog, config.Notify.Buffer)
+	go runNotifyFeed(&config.Notify)
+	go runNotifySweep(&config.Notify)
+}
+
+//outbox模式下由relay将事件放入队列
+func setupOutbox() {
+	if !config.Outbox.Enabled {
+		return
 	}
+	go runOutboxRelay(&config.Outbox)
 }
 
 func setupRedisPool() {
@@ -169,6 +235,10 @@ func stopCPUProfile() {
 
 func Main() {
 	var err error
+	//feed replay子命令：重放kafka中的事件，见replay.go
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
 	// startCPUProfile()
 	// defer stopCPUProfile()
 	go func() {
@@ -192,6 +262,11 @@ func Main() {
 	setupRedisPool()
 	setupMemcacheStorage()
 	setupStorageProxy()
+	setupQueue()
+	setupRetention()
+	setupDegrade()
+	setupNotify()
+	setupOutbox()
 	setupHttpServer(&config.Http, config.LogDir)
 	setupAdminServer(&config.Admin, config.LogDir)
 	
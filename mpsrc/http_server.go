@@ -2,11 +2,13 @@ package mpsrc
 
 import (
 	"fmt"
-	"github.com/garyburd/redigo/redis"
 	"github.com/gin-gonic/gin"
+	"github.com/manucorporat/sse"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 )
 
 type HttpServer struct {
@@ -79,9 +81,33 @@ func handleAddPersonalTimeline(c *gin.Context) {
 		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
 		return
 	}
+	if _, err := strconv.ParseUint(userID, 10, 64); err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	if _, err := strconv.ParseUint(timestamp, 10, 64); err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	//主表和事件在同一个事务内写入
+	if config.Outbox.Enabled {
+		if err := addPersonalTimelineWithOutbox(userID, timestamp, value); err != nil {
+			echoErrorMsg(c, INVAILD_INNER_CODE)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": true})
+		return
+	}
 	//md5处理，生成ValueKey
-	valueKey := StoreValue(value, userID)
-	addPersonalTimeline(userID, timestamp, valueKey)
+	valueKey, err := StoreValue(value, userID)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	if err := addPersonalTimeline(userID, timestamp, valueKey, value); err != nil {
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"data": true})
 }
 
@@ -97,7 +123,13 @@ func handleDelPersonalTimeline(c *gin.Context) {
 		return
 	}
 
-	delPersonalTimeline(userID, timestamp, value)
+	if err := delPersonalTimeline(userID, timestamp, value); err == ErrID {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	} else if err != nil {
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"data": true})
 }
 
@@ -117,7 +149,9 @@ func handlePostPersonalTimeline(c *gin.Context) {
 }
 
 /*
-* 获取好友动态，将所有未push的likes对象的动态拉过来并综合结果排序
+* 获取好友动态，将所有未push的likes对象的动态并发拉过来并归并结果，
+* limit为返回的最大条数，partial表示有部分关注对象的动态拉取超时，
+* aggregate=1时将同一作者短时间内的连续动态合并成一张卡片返回
 */
 func handleGetFriendsTimeline(c *gin.Context) {
 	timeBegin := c.Query("timebegin")
@@ -127,13 +161,23 @@ func handleGetFriendsTimeline(c *gin.Context) {
 		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
 		return
 	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DefaultNum)))
+	if err != nil || limit <= 0 {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
 
-	data, err := getFriendsTimeline(timeBegin, timeEnd, userID)
+	data, partial, err := getFriendsTimeline(timeBegin, timeEnd, userID, limit)
 	if err != nil {
 		echoErrorMsg(c, INVAILD_INNER_CODE)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"data": data})
+	if c.Query("aggregate") == "1" {
+		cards := aggregateTimelines(data, config.Aggregate.Window, config.Aggregate.MinPosts)
+		c.JSON(http.StatusOK, gin.H{"data": cards, "partial": partial})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data, "partial": partial})
 }
 
 /*
@@ -176,30 +220,328 @@ func handlePostFriendsInfo(c *gin.Context) {
 		infoType = LIKES
 	}
 	err := updateFriendsInfo(info, userID, infoType, action)
-	if err != nil {
+	if err == ErrID || err == ErrOpt {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+	} else if err != nil {
 		echoErrorMsg(c, INVAILD_INNER_CODE)
 	} else {
 		c.JSON(http.StatusOK, gin.H{"data": true})
 	}
 }
-//ok
+/*
+* 获取未读数，并原子地将所有动态标记为已读
+*/
 func handleUnreadNum(c *gin.Context) {
-	//配合redis的watch
 	userID := c.Query("userid")
-	conn := redisPool.GetClient(true)
-	if conn == nil || userID == "" {
-		echoErrorMsg(c, INVAILD_INNER_CODE)
+	if userID == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
 		return
 	}
-	defer conn.Close()
-	key := userID + UNREAD
-	unRead, err := redis.Uint64(conn.Do("GET", key))
+	unRead, err := resetUnread(userID)
 	if err != nil {
-		echoErrorMsg(c, INVAILD_RESULT_CODE)
+		mpLogger.Error(err, userID)
+		echoErrorMsg(c, INVAILD_INNER_CODE)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"unread": unRead})
-	conn.Do("SET", key, 0)
+}
+
+/*
+* 标记已读到指定的动态（动态的时间戳），upto为空时全部标记为已读，返回剩余的未读数，
+* 按时间标记只作用于push的未读，pull作者的未读只在全部标记已读时清除
+*/
+func handleMarkRead(c *gin.Context) {
+	userID := c.PostForm("userid")
+	if userID == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	upto, err := strconv.ParseUint(c.DefaultPostForm("upto", "0"), 10, 64)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	_, left, cursor, err := markRead(userID, upto)
+	if err != nil {
+		mpLogger.Error(err, userID)
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unread": left, "cursor": cursor})
+}
+
+/*
+* 获取按作者、类型和分组细分的未读数
+*/
+func handleGetUnreadBreakdown(c *gin.Context) {
+	userID := c.Query("userid")
+	if userID == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	breakdown, err := getUnreadBreakdown(userID)
+	if err != nil {
+		mpLogger.Error(err, userID)
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": breakdown})
+}
+
+/*
+* 清除某一类未读，category为author、type或list，value为对应的作者id、类型或分组名
+*/
+func handleClearUnread(c *gin.Context) {
+	userID := c.PostForm("userid")
+	category := c.PostForm("category")
+	value := c.PostForm("value")
+	if userID == "" || category == "" || value == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	cleared, err := clearUnread(userID, category, value)
+	if err == ErrCategory {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	} else if err != nil {
+		mpLogger.Error(err, userID)
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": cleared})
+}
+
+/*
+* 将关注对象加入或移出自定义分组
+*/
+func handlePostLists(c *gin.Context) {
+	action := c.PostForm("action")
+	userID := c.PostForm("userid")
+	list := c.PostForm("list")
+	like := c.PostForm("like")
+	if userID == "" || list == "" || like == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	err := updateList(userID, list, like, action)
+	if err == ErrOpt {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	} else if err != nil {
+		mpLogger.Error(err, userID)
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+/*
+* 分页获取通知，before为上一页返回的next，返回按组合并后的通知以及未读数
+*/
+func handleGetNotifications(c *gin.Context) {
+	userID := c.Query("userid")
+	if userID == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	before, err := strconv.ParseUint(c.DefaultQuery("before", "0"), 10, 64)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DefaultNotifyNum)))
+	if err != nil || limit <= 0 {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	groups, next, unread, err := getNotifications(userID, before, limit)
+	if err != nil {
+		mpLogger.Error(err, userID)
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": groups, "next": next, "unread": unread})
+}
+
+/*
+* 将通知标记已读到upto（通知组的id），upto为空时全部标记为已读，返回剩余的未读数
+*/
+func handleMarkNotificationsRead(c *gin.Context) {
+	userID := c.PostForm("userid")
+	if userID == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	upto, err := strconv.ParseUint(c.DefaultPostForm("upto", "0"), 10, 64)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	left, err := markNotificationsRead(userID, upto)
+	if err != nil {
+		mpLogger.Error(err, userID)
+		echoErrorMsg(c, INVAILD_INNER_CODE)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unread": left})
+}
+
+/*
+* 点赞、评论、提及和转发，通知对方（receiver），target为相关动态的key
+*/
+func handlePostInteractions(c *gin.Context) {
+	notifyType := c.PostForm("type")
+	userID := c.PostForm("userid")
+	receiver := c.PostForm("receiver")
+	if userID == "" || receiver == "" || notifyType == NotifyFollow {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	if _, err := strconv.ParseUint(userID, 10, 64); err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	if _, err := strconv.ParseUint(receiver, 10, 64); err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	if err := sendNotification(receiver, notifyType, userID, c.PostForm("target"), c.PostForm("content"), Trace{}); err != nil {
+		if err == ErrNotifyType || err == ErrID {
+			echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		} else {
+			echoErrorMsg(c, INVAILD_INNER_CODE)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+//续传位置优先取Last-Event-ID头（浏览器重连时自动带上），其次取last_event_id参数
+func parseLastEventID(c *gin.Context) (uint64, error) {
+	lastID := c.Request.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.DefaultQuery("last_event_id", "0")
+	}
+	return strconv.ParseUint(lastID, 10, 64)
+}
+
+func encodeEvent(w io.Writer, event NotifyEvent) error {
+	var id string
+	if event.ID > 0 {
+		id = strconv.FormatUint(event.ID, 10)
+	}
+	return sse.Encode(w, sse.Event{Id: id, Event: event.Type, Data: event.Data})
+}
+
+/*
+* 通过SSE推送未读数变化和新动态，定期发送心跳注释保持连接，
+* 连接因客户端过慢被hub关闭时结束，客户端重连续传
+*/
+func handleNotifyStream(c *gin.Context) {
+	userID := c.Query("userid")
+	if userID == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	lastID, err := parseLastEventID(c)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	sub, missed, _ := hub.subscribe(userID, lastID)
+	defer hub.unsubscribe(userID, sub)
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	heartbeat := time.NewTicker(config.Notify.Heartbeat)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		//先补齐断线期间的事件，同时让客户端尽快收到响应头
+		if missed != nil {
+			io.WriteString(w, ":connected\n\n")
+			for _, event := range missed {
+				encodeEvent(w, event)
+			}
+			missed = nil
+			return true
+		}
+		select {
+		case event, ok := <-sub.ch:
+			if !ok {
+				return false
+			}
+			if err := encodeEvent(w, event); err != nil {
+				mpLogger.Warn(err, userID)
+				return false
+			}
+		case <-heartbeat.C:
+			io.WriteString(w, ":heartbeat\n\n")
+		}
+		return true
+	})
+}
+
+/*
+* 长轮询：不支持SSE的客户端使用，有事件时立即返回，否则最多等待timeout(ms)，
+* 客户端下次请求带上返回的last_event_id
+*/
+func handleNotifyPoll(c *gin.Context) {
+	userID := c.Query("userid")
+	if userID == "" {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	lastID, err := parseLastEventID(c)
+	if err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	}
+	timeout := config.Notify.PollTimeout
+	if t, err := strconv.Atoi(c.DefaultQuery("timeout", "0")); err != nil {
+		echoErrorMsg(c, INVAILD_ARGUMENT_CODE)
+		return
+	} else if t > 0 && time.Duration(t)*time.Millisecond < timeout {
+		timeout = time.Duration(t) * time.Millisecond
+	}
+
+	sub, events, cursor := hub.subscribe(userID, lastID)
+	defer hub.unsubscribe(userID, sub)
+	if len(events) == 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case event, ok := <-sub.ch:
+			if ok {
+				events = append(events, event)
+			}
+		case <-timer.C:
+		case <-c.Writer.CloseNotify():
+			return
+		}
+	}
+	//一并带上已经到达的事件
+Drain:
+	for {
+		select {
+		case event, ok := <-sub.ch:
+			if !ok {
+				break Drain
+			}
+			events = append(events, event)
+		default:
+			break Drain
+		}
+	}
+	if lastID > cursor {
+		cursor = lastID
+	}
+	for _, event := range events {
+		if event.ID > cursor {
+			cursor = event.ID
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": events, "last_event_id": cursor})
 }
 
 /*
@@ -212,9 +554,18 @@ func (hs *HttpServer) setupRouters() {
 	engine.GET("api/friendstimeline", handleGetFriendsTimeline)
 	engine.GET("api/friendsinfo", handleGetFriendsInfo)
 	engine.GET("api/unreadnum", handleUnreadNum)
+	engine.GET("api/unreadbreakdown", handleGetUnreadBreakdown)
+	engine.GET("api/notifications", handleGetNotifications)
+	engine.GET("api/notify", handleNotifyPoll)
+	engine.GET("api/notify/stream", handleNotifyStream)
 	//增加和删除
 	engine.POST("api/personaltimeline", handlePostPersonalTimeline)
 	engine.POST("api/friendsinfo", handlePostFriendsInfo)
+	engine.POST("api/unreadnum", handleMarkRead)
+	engine.POST("api/unreadbreakdown", handleClearUnread)
+	engine.POST("api/lists", handlePostLists)
+	engine.POST("api/notifications", handleMarkNotificationsRead)
+	engine.POST("api/interactions", handlePostInteractions)
 }
 
 /*
@@ -226,13 +577,10 @@ func (hs *HttpServer) setupRouters() {
 func (hs *HttpServer) StartHttp(host string, port int,
  needAccessLog bool, logDir string) {
 	initErrorMsgMap()
-	go runProducer()
-	go watchDataChange()
-	go updatePushFriendsTimelineOfDB()
-	go updateLikesOfDB()
-	go updateFansOfDB()
-	go updatePersonalTimelineOfDB()
-	go updateValueOfDB()
+	if err := startConsumers(); err != nil {
+		fmt.Printf("start consumers failed, %s\n", err)
+		os.Exit(1)
+	}
 	hs.ginServer = GetDefaultGinEngine(needAccessLog, "http", logDir)
 	hs.setupRouters()
 	mpLogger.Info("start http server successfully.")
@@ -5,357 +5,226 @@
 package mpsrc
 
 import (
-	"github.com/Shopify/sarama"
-	"log"
-	"time"
+	"feed/mq"
 	"strconv"
-	"strings"
+)
+
+const (
+	MQKafka      = "kafka"
+	MQMemory     = "memory"
+	OffsetNewest = "newest"
+	OffsetOldest = "oldest"
 )
 
 var (
-	Stop      chan bool = make(chan bool, 7)
-	producer  sarama.AsyncProducer
-	// consumer  sarama.Consumer
-	// err       error
+	publisher  mq.Publisher
+	subscriber mq.Subscriber
 )
 
-//生产者
-func runProducer() {
-	producer, err = sarama.NewAsyncProducer([]string{config.Kafka.ProAddr}, nil)
-	if err != nil {
-		panic(err)
+func mqOptions() *mq.Options {
+	opts := &mq.Options{
+		OnError: func(msg *mq.Message, err error) {
+			mpLogger.Error(err, msg.Topic, string(msg.Key))
+		},
+		Group:          config.Kafka.Group,
+		InitialOffset:  mq.OffsetNewest,
+		CommitInterval: config.Kafka.CommitInterval,
+		Version:        config.Kafka.Version,
 	}
+	if config.Kafka.InitialOffset == OffsetOldest {
+		opts.InitialOffset = mq.OffsetOldest
+	}
+	return opts
+}
 
-	defer func() {
-		if err = producer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-
-ProducerLoop:
-	for {
-		select {
-		case <-Stop:
-			break ProducerLoop
-		}
+//根据配置创建队列，memory只用于单机部署和测试，不需要kafka
+func setupMQ() error {
+	opts := mqOptions()
+	if config.Kafka.Driver == MQMemory {
+		broker := mq.NewMemoryBroker(0, 0, opts)
+		publisher, subscriber = broker, broker
+		return nil
+	}
+	kp, err := mq.NewKafkaPublisher([]string{config.Kafka.ProAddr}, opts)
+	if err != nil {
+		return err
+	}
+	ks, err := mq.NewKafkaSubscriber([]string{config.Kafka.Addr}, opts)
+	if err != nil {
+		kp.Close()
+		return err
 	}
+	publisher, subscriber = kp, ks
+	return nil
+}
 
-	log.Println("Closed")
+//生产者，key是消息所属的用户id（value的key除外），决定消息的分区，同一用户的消息按顺序消费
+func publish(topic, key, value string) error {
+	return publisher.Publish(&mq.Message{Topic: topic, Key: []byte(key), Value: []byte(value)})
 }
 
-//通知consumer正常关闭
-func stopKafka() {
-	Stop <- true
-	Stop <- true
-	Stop <- true
-	Stop <- true
-	Stop <- true
-	Stop <- true
-	Stop <- true
-	time.Sleep(time.Millisecond * 100)
+//同步生产，等待kafka确认后返回
+func publishSync(topic, key, value string) error {
+	return publisher.PublishSync(&mq.Message{Topic: topic, Key: []byte(key), Value: []byte(value)})
 }
 
-//粉丝列表的变更消费
-func updateFansOfDB() {
-	consumer, err := sarama.NewConsumer([]string{config.Kafka.Addr}, nil)
-	if err != nil {
-		panic(err)
-	}
+//各topic的消费
+var topicHandlers = map[string]mq.Handler{
+	ADDFANS:             handleFansChange,
+	DELFANS:             handleFansChange,
+	ADDLIKES:            handleLikesChange,
+	DELLIKES:            handleLikesChange,
+	FRIENDSTIMELINE:     handlePushFriendsTimeline,
+	ADDPERSONALTIMELINE: handlePersonalTimelineChange,
+	DELPERSONALTIMELINE: handlePersonalTimelineChange,
+	ADDVALUE:            handleValueChange,
+	DELVALUE:            handleValueChange,
+	UNREAD:              handleDataChange,
+	NOTIFICATION:        handleNotification,
+}
 
-	defer func() {
-		if err := consumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
+//按事件去重，写入失败的消息按退避重试，仍然失败的放入死信队列
+func startConsumers() error {
+	policy := retryPolicy()
+	for topic, handler := range topicHandlers {
+		single := mq.WithRetry(dedupe(handler, &config.Dedupe), policy, deadLetter)
+		//配置了批量写入的topic整批写入，失败后逐条处理
+		bc, ok := config.Batch[batchTables[topic]]
+		var err error
+		if ok && bc.Size > 1 {
+			batch := mq.WithBatchRetry(dedupeBatch(batchHandlers[topic], &config.Dedupe), policy, eachMessage(single))
+			err = subscriber.SubscribeBatch([]string{topic}, batch, bc.Size, bc.Interval)
+		} else {
+			err = subscriber.Subscribe([]string{topic}, single)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	//死信写入失败时原地重试，仍然失败的不提交，由subscriber重新投递
+	return subscriber.Subscribe([]string{DEADLETTER}, keepDeadLetter(mq.WithRetry(dedupe(handleDeadLetter, &config.Dedupe), policy, nil)))
+}
 
-	fansAddPartitionConsumer, err := consumer.ConsumePartition(ADDFANS, 0, sarama.OffsetNewest)
-	if err != nil {
-		panic(err)
-		return
-	}
+/*
+* 重置消费位置，offset为oldest、newest或者具体的offset，partition为-1时重置所有分区；
+* 对消费组的所有分区生效，多实例部署时需要先停止其他实例，否则返回mq.ErrGroupActive
+ */
+func resetOffset(topic string, partition int32, offset string) error {
+	if _, ok := topicHandlers[topic]; !ok {
+		return ErrTopic
+	}
+	var position int64
+	switch offset {
+	case OffsetOldest:
+		position = mq.OffsetOldest
+	case OffsetNewest:
+		position = mq.OffsetNewest
+	default:
+		var err error
+		if position, err = strconv.ParseInt(offset, 10, 64); err != nil || position < 0 {
+			return ErrOffset
+		}
+	}
+	return subscriber.ResetOffset(topic, partition, position)
+}
 
-	defer func() {
-		if err := fansAddPartitionConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-	fansDelPartitionConsumer, err := consumer.ConsumePartition(DELFANS, 0, sarama.OffsetNewest)
-	if err != nil {
-		panic(err)
-		return
+//通知consumer正常关闭，等待正在处理的消息完成
+func stopKafka() {
+	if err := subscriber.Close(); err != nil {
+		mpLogger.Error(err)
 	}
-
-	defer func() {
-		if err := fansDelPartitionConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-FansPartitionConsumerLoop:
-	for {
-		select {
-		case cm := <-fansAddPartitionConsumer.Messages():
-			userID, err := strconv.Atoi(string(cm.Key))
-			if err != nil {
-				continue
-			}
-			fanID, err := strconv.Atoi(string(cm.Value))
-			if err != nil {
-				continue
-			}
-			updateFriendsInfoOfDB("fid", "fanslist", "add", uint64(userID), uint64(fanID))
-		case cm := <-fansDelPartitionConsumer.Messages():
-			userID, err := strconv.Atoi(string(cm.Key))
-			if err != nil {
-				continue
-			}
-			fanID, err := strconv.Atoi(string(cm.Value))
-			if err != nil {
-				continue
-			}
-			updateFriendsInfoOfDB("fid", "fanslist", "delete", uint64(userID), uint64(fanID))
-		case <-Stop:
-			break FansPartitionConsumerLoop
-		}
+	if err := publisher.Close(); err != nil {
+		mpLogger.Error(err)
 	}
 }
 
-//关注关系的变更消费
-func updateLikesOfDB() {
-	consumer, err := sarama.NewConsumer([]string{config.Kafka.Addr}, nil)
+//粉丝列表的变更消费
+func handleFansChange(msg *mq.Message) error {
+	var event RelationEvent
+	env, err := decodeEvent(msg, &event)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if msg.Topic == ADDFANS {
+		err = updateFriendsInfoOfDB("fid", "fanslist", "add", event.UserID, event.TargetID)
+	} else {
+		err = updateFriendsInfoOfDB("fid", "fanslist", "delete", event.UserID, event.TargetID)
 	}
-
-	defer func() {
-		if err := consumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-
-	LikesAddPartitionConsumer, err := consumer.ConsumePartition(ADDLIKES, 0, sarama.OffsetNewest)
 	if err != nil {
-		panic(err)
-		return
+		return err
 	}
+	clearWrite(event.UserID, relationField(FANS, event.TargetID), env.ID)
+	return nil
+}
 
-	defer func() {
-		if err := LikesAddPartitionConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-	LikesDelPartitionConsumer, err := consumer.ConsumePartition(DELLIKES, 0, sarama.OffsetNewest)
+//关注关系的变更消费
+func handleLikesChange(msg *mq.Message) error {
+	var event RelationEvent
+	env, err := decodeEvent(msg, &event)
 	if err != nil {
-		panic(err)
-		return
+		return err
 	}
-
-	defer func() {
-		if err := LikesDelPartitionConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-LikesPartitionConsumerLoop:
-	for {
-		select {
-		case cm := <-LikesAddPartitionConsumer.Messages():
-			userID, err := strconv.Atoi(string(cm.Key))
-			if err != nil {
-				continue
-			}
-			likeID, err := strconv.Atoi(string(cm.Value))
-			if err != nil {
-				continue
-			}
-			updateFriendsInfoOfDB("lid", "likeslist", "add", uint64(userID), uint64(likeID))
-		case cm := <-LikesDelPartitionConsumer.Messages():
-			userID, err := strconv.Atoi(string(cm.Key))
-			if err != nil {
-				continue
-			}
-			likeID, err := strconv.Atoi(string(cm.Value))
-			if err != nil {
-				continue
-			}
-			updateFriendsInfoOfDB("lid", "likeslist", "delete", uint64(userID), uint64(likeID))
-		case <-Stop:
-			break LikesPartitionConsumerLoop
+	if msg.Topic == ADDLIKES {
+		if err := updateFriendsInfoOfDB("lid", "likeslist", "add", event.UserID, event.TargetID); err != nil {
+			return err
 		}
+		initSeqSeen(event.UserID, event.TargetID)
+	} else if err := updateFriendsInfoOfDB("lid", "likeslist", "delete", event.UserID, event.TargetID); err != nil {
+		return err
 	}
+	clearWrite(event.UserID, relationField(LIKES, event.TargetID), env.ID)
+	return nil
 }
 
 //push动态的消费
-func updatePushFriendsTimelineOfDB() {
-	consumer, err := sarama.NewConsumer([]string{config.Kafka.Addr}, nil)
+func handlePushFriendsTimeline(msg *mq.Message) error {
+	setConsumerBacklog(msg)
+	var event PushEvent
+	env, err := decodeEvent(msg, &event)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	publishedAt := env.publishedAt()
+	observeLag(StageConsumer, publishedAt)
 
-	defer func() {
-		if err := consumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-
-	pushPartitionConsumer, err := consumer.ConsumePartition(FRIENDSTIMELINE, 0, sarama.OffsetNewest)
+	enterStage(StageDBWrite)
+	err = addPushFriendsTimeline(event.UserID, event.Author, event.Timestamp, event.ValueKey)
+	leaveStage(StageDBWrite)
 	if err != nil {
-		panic(err)
-		return
-	}
-
-	defer func() {
-		if err := pushPartitionConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-PushPartitionConsumerLoop:
-	for {
-		select {
-		case cm := <-pushPartitionConsumer.Messages():
-			value := strings.Split(string(cm.Value), ",")
-			userID, err := strconv.Atoi(string(cm.Key))
-			if err != nil {
-				continue
-			}
-			likesID, err := strconv.Atoi(value[0])
-			if err != nil {
-				continue
-			}
-			ts, err := strconv.Atoi(value[1])
-			if err != nil {
-				continue
-			}
-			
-			addPushFriendsTimeline(uint64(userID), uint64(likesID), uint64(ts), value[2])
-		case <-Stop:
-			break PushPartitionConsumerLoop
-		}
+		return err
 	}
+	observeLag(StageDBWrite, publishedAt)
+	notifyPost(event.UserID, event.Author, event.Timestamp, event.ValueKey)
+	return nil
 }
 
 //个人动态的消费
-func updatePersonalTimelineOfDB() {
-	consumer, err := sarama.NewConsumer([]string{config.Kafka.Addr}, nil)
+func handlePersonalTimelineChange(msg *mq.Message) error {
+	var event TimelineEvent
+	env, err := decodeEvent(msg, &event)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
-	defer func() {
-		if err := consumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-
-	AddPersonalPartitionConsumer, err := consumer.ConsumePartition(ADDPERSONALTIMELINE, 0, sarama.OffsetNewest)
-	if err != nil {
-		panic(err)
-		return
+	if msg.Topic == DELPERSONALTIMELINE {
+		err = updatePersonalTimeline(event.UserID, event.Timestamp, "", "delete")
+	} else {
+		err = updatePersonalTimeline(event.UserID, event.Timestamp, event.ValueKey, "add")
 	}
-
-	defer func() {
-		if err := AddPersonalPartitionConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-	DelPersonalPartitionConsumer, err := consumer.ConsumePartition(DELPERSONALTIMELINE, 0, sarama.OffsetNewest)
 	if err != nil {
-		panic(err)
-		return
-	}
-
-	defer func() {
-		if err := DelPersonalPartitionConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-PerPartitionConsumerLoop:
-	for {
-		select {
-		case cm := <-AddPersonalPartitionConsumer.Messages():
-			value := strings.Split(string(cm.Value), ",")
-			uid, err := strconv.Atoi(string(cm.Key))
-			if err != nil {
-				continue
-			}
-			ts, err := strconv.Atoi(value[0])
-			if err != nil {
-				continue
-			}
-			updatePersonalTimeline(uint64(uid), uint64(ts), value[1], "add")
-		case cm := <-DelPersonalPartitionConsumer.Messages():
-			uid, err := strconv.Atoi(string(cm.Key))
-			if err != nil {
-				continue
-			}
-			ts, err := strconv.Atoi(string(cm.Value))
-			if err != nil {
-				continue
-			}
-			updatePersonalTimeline(uint64(uid), uint64(ts), "", "delete")
-		case <-Stop:
-			break PerPartitionConsumerLoop
-		}
+		return err
 	}
+	clearWrite(event.UserID, postField(event.Timestamp), env.ID)
+	return nil
 }
 
 //value增删的消费
-func updateValueOfDB() {
-	consumer, err := sarama.NewConsumer([]string{config.Kafka.Addr}, nil)
-	if err != nil {
-		panic(err)
+func handleValueChange(msg *mq.Message) error {
+	var event ValueEvent
+	if _, err := decodeEvent(msg, &event); err != nil {
+		return err
 	}
-
-	defer func() {
-		if err := consumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-
-	AddValueConsumer, err := consumer.ConsumePartition(ADDVALUE, 0, sarama.OffsetNewest)
-	if err != nil {
-		panic(err)
-		return
-	}
-
-	defer func() {
-		if err := AddValueConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-	DelValueConsumer, err := consumer.ConsumePartition(DELVALUE, 0, sarama.OffsetNewest)
-	if err != nil {
-		panic(err)
-		return
-	}
-
-	defer func() {
-		if err := DelValueConsumer.Close(); err != nil {
-			mpLogger.Error(err)
-			return
-		}
-	}()
-ValuePartitionConsumerLoop:
-	for {
-		select {
-		case cm := <-AddValueConsumer.Messages():
-			addValueToDB(string(cm.Key), string(cm.Value))
-		case cm := <-DelValueConsumer.Messages():
-			delValueFromDB(string(cm.Key))
-		case <-Stop:
-			break ValuePartitionConsumerLoop
-		}
+	if msg.Topic == ADDVALUE {
+		return addValueToDB(event.Key, event.Value)
 	}
+	return delValueFromDB(event.Key)
 }
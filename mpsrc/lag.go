@@ -0,0 +1,159 @@
+package mpsrc
+
+import (
+	"feed/mq"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+* 动态投递延迟统计：addPersonalTimeline时在消息上打上发布时间，之后在各阶段
+* 完成时记录距发布时间的耗时，即producer入队、consumer收到、写入DB、未读数增加，
+* 同时记录各阶段当前积压的消息数
+ */
+const (
+	StageProducer = "producer"
+	StageConsumer = "consumer"
+	StageDBWrite  = "dbwrite"
+	StageUnread   = "unread"
+
+	lagSampleSize = 1024 // 每个阶段保留最近的样本数
+)
+
+type StageStats struct {
+	Count   uint64           `json:"count"`
+	Backlog int64            `json:"backlog"`
+	Topics  map[string]int64 `json:"topics,omitempty"`
+	P50     float64          `json:"p50_ms"`
+	P90     float64          `json:"p90_ms"`
+	P99     float64          `json:"p99_ms"`
+	Max     float64          `json:"max_ms"`
+}
+
+type stageTracker struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+	count   uint64
+	backlog int64
+}
+
+func newStageTracker(size int) *stageTracker {
+	return &stageTracker{samples: make([]time.Duration, 0, size)}
+}
+
+func (st *stageTracker) observe(d time.Duration) {
+	st.Lock()
+	defer st.Unlock()
+	if len(st.samples) < cap(st.samples) {
+		st.samples = append(st.samples, d)
+	} else {
+		st.samples[st.next] = d
+		st.next = (st.next + 1) % len(st.samples)
+	}
+	st.count++
+}
+
+func (st *stageTracker) stats() StageStats {
+	st.Lock()
+	samples := make([]time.Duration, len(st.samples))
+	copy(samples, st.samples)
+	stats := StageStats{Count: st.count}
+	st.Unlock()
+
+	stats.Backlog = atomic.LoadInt64(&st.backlog)
+	if len(samples) == 0 {
+		return stats
+	}
+	sort.Sort(durations(samples))
+	stats.P50 = toMillisecond(percentile(samples, 0.50))
+	stats.P90 = toMillisecond(percentile(samples, 0.90))
+	stats.P99 = toMillisecond(percentile(samples, 0.99))
+	stats.Max = toMillisecond(samples[len(samples)-1])
+	return stats
+}
+
+type durations []time.Duration
+
+func (ds durations) Len() int           { return len(ds) }
+func (ds durations) Swap(i, j int)      { ds[i], ds[j] = ds[j], ds[i] }
+func (ds durations) Less(i, j int) bool { return ds[i] < ds[j] }
+
+//sorted需升序且非空
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(float64(len(sorted))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+func toMillisecond(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+var (
+	lagTrackers = map[string]*stageTracker{
+		StageProducer: newStageTracker(lagSampleSize),
+		StageConsumer: newStageTracker(lagSampleSize),
+		StageDBWrite:  newStageTracker(lagSampleSize),
+		StageUnread:   newStageTracker(lagSampleSize),
+	}
+	//consumer阶段的积压按topic、分区记录（high water mark - 当前offset）
+	consumerBacklogMu sync.Mutex
+	consumerBacklog   = make(map[string]map[int32]int64)
+)
+
+//记录某阶段完成时距发布时间的耗时
+func observeLag(stage string, publishedAt time.Time) {
+	if publishedAt.IsZero() {
+		return
+	}
+	lagTrackers[stage].observe(time.Since(publishedAt))
+}
+
+func enterStage(stage string) {
+	atomic.AddInt64(&lagTrackers[stage].backlog, 1)
+}
+
+func leaveStage(stage string) {
+	atomic.AddInt64(&lagTrackers[stage].backlog, -1)
+}
+
+func setConsumerBacklog(msg *mq.Message) {
+	backlog := msg.HighWaterMark - msg.Offset - 1
+	if backlog < 0 {
+		backlog = 0
+	}
+	consumerBacklogMu.Lock()
+	if consumerBacklog[msg.Topic] == nil {
+		consumerBacklog[msg.Topic] = make(map[int32]int64)
+	}
+	consumerBacklog[msg.Topic][msg.Partition] = backlog
+	consumerBacklogMu.Unlock()
+}
+
+func getLagStats() map[string]StageStats {
+	result := make(map[string]StageStats, len(lagTrackers))
+	for stage, st := range lagTrackers {
+		result[stage] = st.stats()
+	}
+
+	consumer := result[StageConsumer]
+	consumer.Topics = make(map[string]int64)
+	consumerBacklogMu.Lock()
+	for topic, partitions := range consumerBacklog {
+		for _, backlog := range partitions {
+			consumer.Topics[topic] += backlog
+			consumer.Backlog += backlog
+		}
+	}
+	consumerBacklogMu.Unlock()
+	result[StageConsumer] = consumer
+	return result
+}
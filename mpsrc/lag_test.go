@@ -0,0 +1,21 @@
+package mpsrc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStageTracker(t *testing.T) {
+	st := newStageTracker(100)
+	for i := 1; i <= 200; i++ {
+		st.observe(time.Duration(i) * time.Millisecond)
+	}
+	stats := st.stats()
+	if stats.Count != 200 {
+		t.Errorf("expected: %v, got: %v", 200, stats.Count)
+	}
+	//只保留最近的100个样本，即101ms~200ms
+	if stats.P50 != 150 || stats.P99 != 199 || stats.Max != 200 {
+		t.Errorf("Test stageTracker percentile failed, got %+v", stats)
+	}
+}
@@ -0,0 +1,45 @@
+package mpsrc
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+* 多实例部署时只需要一个实例执行的后台任务（outbox relay、inbox清理）通过redis上的租约选出执行者：
+* 持有租约的实例每轮续期，实例退出或者卡住超过租约时间后由其他实例接手
+ */
+var (
+	leaseOwner = leaseOwnerOf()
+
+	//KEYS: 租约；ARGV: 持有者,租约时间(ms)
+	leaseScript = redis.NewScript(1, `
+local owner = redis.call('GET', KEYS[1])
+if not owner then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+if owner == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0`)
+)
+
+func leaseOwnerOf() string {
+	host, _ := os.Hostname()
+	return host + ":" + strconv.Itoa(os.Getpid()) + ":" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+//获取或者续期名为name的租约，返回本实例是否持有
+func acquireLease(name string, ttl time.Duration) (bool, error) {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return false, ErrNilRedisConn
+	}
+	defer conn.Close()
+	return redis.Bool(leaseScript.Do(conn, LEASE+name, leaseOwner, int64(ttl/time.Millisecond)))
+}
@@ -0,0 +1,64 @@
+package mpsrc
+
+import (
+	"container/heap"
+)
+
+// k路归并时每一路的读取位置，每一路均按时间升序，从尾部（最新）开始读
+type mergeCursor struct {
+	tls Timelines
+	pos int
+}
+
+type mergeHeap []*mergeCursor
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+func (h mergeHeap) Less(i, j int) bool {
+	return h[i].tls[h[i].pos].Timestamp > h[j].tls[h[j].pos].Timestamp
+}
+func (h *mergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*mergeCursor))
+}
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	*h = old[:n-1]
+	return c
+}
+
+/*
+* 对多路按时间升序排列的动态做k路归并，取时间最新的limit条后停止，
+* 结果仍按时间升序返回；limit<=0时不做限制
+ */
+func mergeTimelines(sources []Timelines, limit int) Timelines {
+	total := 0
+	h := make(mergeHeap, 0, len(sources))
+	for _, tls := range sources {
+		if len(tls) == 0 {
+			continue
+		}
+		total += len(tls)
+		h = append(h, &mergeCursor{tls: tls, pos: len(tls) - 1})
+	}
+	if limit <= 0 || limit > total {
+		limit = total
+	}
+	heap.Init(&h)
+
+	merged := make(Timelines, limit)
+	for i := limit - 1; i >= 0; i-- {
+		c := h[0]
+		merged[i] = c.tls[c.pos]
+		c.pos--
+		if c.pos < 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,42 @@
+package mpsrc
+
+import (
+	"testing"
+)
+
+func newTimelines(userID uint64, tss ...uint64) Timelines {
+	tls := make(Timelines, 0, len(tss))
+	for _, ts := range tss {
+		tls = append(tls, &TimelineKey{UserID: userID, Timestamp: ts})
+	}
+	return tls
+}
+
+func TestMergeTimelines(t *testing.T) {
+	sources := []Timelines{
+		newTimelines(1, 1, 4, 9),
+		newTimelines(2, 2, 3, 10),
+		nil,
+		newTimelines(3, 5),
+	}
+
+	merged := mergeTimelines(sources, 0)
+	if len(merged) != 7 {
+		t.Fatalf("Test mergeTimelines failed, got %d items", len(merged))
+	}
+	for i := 1; i < len(merged); i++ {
+		if merged[i-1].Timestamp > merged[i].Timestamp {
+			t.Error("Test mergeTimelines failed, result is not ascending")
+		}
+	}
+
+	merged = mergeTimelines(sources, 3)
+	if len(merged) != 3 || merged[0].Timestamp != 5 ||
+		merged[1].Timestamp != 9 || merged[2].Timestamp != 10 {
+		t.Error("Test mergeTimelines with limit failed")
+	}
+
+	if len(mergeTimelines(nil, 10)) != 0 {
+		t.Error("Test mergeTimelines with no source failed")
+	}
+}
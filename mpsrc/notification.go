@@ -0,0 +1,284 @@
+package mpsrc
+
+import (
+	"encoding/json"
+	"feed/mq"
+	"feed/storage"
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* 通知中心：关注、点赞、评论、提及和转发经NOTIFICATION队列写入mysql的notification表，
+* 同一条动态的点赞（转发）以及所有的新关注会按gkey合并成一组（"A等6人赞了你的动态"），
+* 评论和提及每条单独成组；分页按组内最新的通知id倒序，
+* 已读状态为每个用户的已读位置（通知id），未读的通知id存放在redis的zset中，
+* 加入未读和标记已读都在脚本内比较已读位置，与并发写入的新通知之间没有丢失更新；
+* 每页结果缓存在memcache中，缓存key带上用户的通知版本号，写入新通知时递增版本号即可让旧缓存失效
+ */
+const (
+	NotifyFollow  = "follow"
+	NotifyLike    = "like"
+	NotifyComment = "comment"
+	NotifyMention = "mention"
+	NotifyRepost  = "repost"
+
+	NotifyActorsNum  = 3    //每组展示的最近的用户数
+	MaxUnreadNotices = 1000 //未读的通知id最多保留的个数，超过时去掉最早的
+)
+
+var (
+	//KEYS: 未读zset,已读位置,版本号；ARGV: 通知id,zset上限；返回是否新加入未读
+	notifyUnreadScript = redis.NewScript(3, `
+local id = tonumber(ARGV[1])
+local added = 0
+if id > tonumber(redis.call('GET', KEYS[2]) or '0') then
+	added = redis.call('ZADD', KEYS[1], id, id)
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, -(tonumber(ARGV[2]) + 1))
+end
+redis.call('INCR', KEYS[3])
+return added`)
+
+	//KEYS: 未读zset,已读位置；ARGV: 已读到的通知id，为0时为最新的未读通知
+	markNotifyReadScript = redis.NewScript(2, `
+local cursor = tonumber(redis.call('GET', KEYS[2]) or '0')
+local upto = tonumber(ARGV[1])
+if upto == 0 then
+	local newest = redis.call('ZREVRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	if #newest > 0 then
+		upto = tonumber(newest[2])
+	end
+end
+if upto > cursor then
+	redis.call('SET', KEYS[2], upto)
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', upto)
+end
+return redis.call('ZCARD', KEYS[1])`)
+)
+
+type NotificationGroup struct {
+	ID        uint64   `json:"id"` // 组内最新一条通知的id，用于分页
+	Type      string   `json:"type"`
+	Target    string   `json:"target"` // 被点赞、评论或转发的动态，关注时为空
+	Actors    []uint64 `json:"actors"` // 最近的几个用户
+	Count     int      `json:"count"`
+	Timestamp uint64   `json:"timestamp"`
+	Content   string   `json:"content"` // 评论或提及的内容
+	Unread    bool     `json:"unread"`
+}
+
+func isNotifyType(notifyType string) bool {
+	switch notifyType {
+	case NotifyFollow, NotifyLike, NotifyComment, NotifyMention, NotifyRepost:
+		return true
+	}
+	return false
+}
+
+//点赞和转发按动态合并，关注全部合并，评论和提及不合并
+func notifyGroupKey(notifyType string, actor uint64, target string, ts uint64) string {
+	switch notifyType {
+	case NotifyFollow:
+		return ""
+	case NotifyLike, NotifyRepost:
+		return target
+	}
+	return strconv.FormatUint(actor, 10) + ":" + strconv.FormatUint(ts, 10) + ":" + target
+}
+
+//按id倒序的用户列表，重新关注的同一个用户只保留最近的一次，最多n个
+func parseActors(actors string, n int) []uint64 {
+	ids := make([]uint64, 0, n)
+	seen := make(map[uint64]bool, n)
+	for _, actor := range strings.Split(actors, ",") {
+		if len(ids) == n {
+			break
+		}
+		if id, err := strconv.ParseUint(actor, 10, 64); err == nil && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+//去重的依据：关注按关注的时间，取关后重新关注会产生新的通知；点赞和转发同一条动态只通知一次
+func notifyDedupeKey(notifyType string, actor uint64, target string, ts uint64) string {
+	if notifyType == NotifyFollow {
+		return strconv.FormatUint(ts, 10)
+	}
+	return notifyGroupKey(notifyType, actor, target, ts)
+}
+
+/*
+* 发送一条通知到队列，trace为触发通知的事件，没有时为空
+ */
+func sendNotification(receiver, notifyType, actor, target, content string, trace Trace) error {
+	if !isNotifyType(notifyType) {
+		return ErrNotifyType
+	}
+	if receiver == actor {
+		return nil
+	}
+	receiverID, err := strconv.ParseUint(receiver, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	actorID, err := strconv.ParseUint(actor, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	now := time.Now()
+	_, err = publishEvent(NOTIFICATION, receiver, &NotificationEvent{
+		Receiver:  receiverID,
+		Type:      notifyType,
+		Actor:     actorID,
+		Target:    target,
+		Timestamp: uint64(now.Unix()),
+		Content:   content,
+	}, now, trace)
+	return err
+}
+
+//评论和提及同时计入好友动态的未读数细分，返回对应的未读类型
+func unreadTypeOf(notifyType string) (string, bool) {
+	switch notifyType {
+	case NotifyComment:
+		return UnreadComment, true
+	case NotifyMention:
+		return UnreadMention, true
+	}
+	return "", false
+}
+
+//消费通知：写入mysql，递增未读数和版本号，并推送给在线的用户
+func handleNotification(msg *mq.Message) error {
+	var event NotificationEvent
+	env, err := decodeEvent(msg, &event)
+	if err != nil {
+		return err
+	}
+	if !isNotifyType(event.Type) {
+		return mq.Permanent(ErrNotifyType)
+	}
+	//重复的通知（比如同一个人多次点赞）不再写入，返回已有的id；
+	//之后的步骤都是幂等的，重复投递时重新执行，保证上次失败的步骤能够完成
+	id, _, err := addNotificationOfDB(event.Receiver, event.Actor, event.Timestamp, event.Type, event.Target, event.Content,
+		notifyGroupKey(event.Type, event.Actor, event.Target, event.Timestamp),
+		notifyDedupeKey(event.Type, event.Actor, event.Target, event.Timestamp))
+	if err != nil {
+		return err
+	}
+
+	userID := strconv.FormatUint(event.Receiver, 10)
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return ErrNilRedisConn
+	}
+	defer conn.Close()
+	added, err := redis.Int(notifyUnreadScript.Do(conn, userID+NOTIFYUNREAD, userID+NOTIFYCURSOR, userID+NOTIFYVERSION, id, MaxUnreadNotices))
+	if err != nil {
+		return err
+	}
+	//评论和提及计入未读，未读成员由类型、用户和时间组成，重复发布不会重复计数
+	if unreadType, ok := unreadTypeOf(event.Type); ok {
+		_, err := publishEvent(UNREAD, userID, &UnreadChangeEvent{
+			Op:        "increase",
+			Author:    event.Actor,
+			Timestamp: event.Timestamp,
+			Type:      unreadType,
+			Receiver:  event.Receiver,
+		}, time.Now(), env.child())
+		if err != nil {
+			return err
+		}
+	}
+	//只推送新加入未读的通知
+	if added > 0 {
+		broadcast(newHubMessage(EventNotification, []uint64{event.Receiver}, "", NotificationGroup{
+			ID:        id,
+			Type:      event.Type,
+			Target:    event.Target,
+			Actors:    []uint64{event.Actor},
+			Count:     1,
+			Timestamp: event.Timestamp,
+			Content:   event.Content,
+			Unread:    true,
+		}))
+	}
+	return nil
+}
+
+//获取用户的通知版本号、已读位置和未读数
+func getNotifyState(userID string) (version, cursor, unread uint64, err error) {
+	conn := redisPool.GetClient(false)
+	if conn == nil {
+		return 0, 0, 0, ErrNilRedisConn
+	}
+	defer conn.Close()
+	conn.Send("MGET", userID+NOTIFYVERSION, userID+NOTIFYCURSOR)
+	conn.Send("ZCARD", userID+NOTIFYUNREAD)
+	rs, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	values, err := redis.Values(rs[0], nil)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if _, err = redis.Scan(values, &version, &cursor); err != nil {
+		return 0, 0, 0, err
+	}
+	unread, err = redis.Uint64(rs[1], nil)
+	return version, cursor, unread, err
+}
+
+/*
+* 分页获取通知，before为上一页最后一组的id，为0时从最新的开始，
+* 返回的next为0表示没有更多
+ */
+func getNotifications(userID string, before uint64, limit int) ([]*NotificationGroup, uint64, uint64, error) {
+	version, cursor, unread, err := getNotifyState(userID)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	key := userID + NOTIFICATIONS + strconv.FormatUint(version, 10) + ":" +
+		strconv.FormatUint(before, 10) + ":" + strconv.Itoa(limit)
+	groups := make([]*NotificationGroup, 0)
+	rs := storageProxy.Get(storage.SetReadStrategyToContent(context.Background(), storage.CacheOnly), key)
+	if rs != nil {
+		if v, ok := rs.Value.([]byte); ok {
+			json.Unmarshal(v, &groups)
+		}
+	} else {
+		uid, err := strconv.ParseUint(userID, 10, 64)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if groups, err = getNotificationsFromDB(uid, before, limit, key); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	var next uint64
+	for _, group := range groups {
+		group.Unread = group.ID > cursor
+	}
+	if len(groups) == limit {
+		next = groups[len(groups)-1].ID
+	}
+	return groups, next, unread, nil
+}
+
+//标记已读到upto（通知id），为0时全部标记为已读，返回剩余的未读数；已读位置只前进不后退
+func markNotificationsRead(userID string, upto uint64) (uint64, error) {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return 0, ErrNilRedisConn
+	}
+	defer conn.Close()
+	return redis.Uint64(markNotifyReadScript.Do(conn, userID+NOTIFYUNREAD, userID+NOTIFYCURSOR, upto))
+}
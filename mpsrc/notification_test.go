@@ -0,0 +1,60 @@
+package mpsrc
+
+import (
+	"testing"
+)
+
+func TestNotifyGroupKey(t *testing.T) {
+	if key := notifyGroupKey(NotifyFollow, 1, "", 100); key != "" {
+		t.Errorf("expected: %v, got: %v", "", key)
+	}
+	//同一条动态的点赞合并到一组
+	if notifyGroupKey(NotifyLike, 1, "abc", 100) != notifyGroupKey(NotifyLike, 2, "abc", 200) {
+		t.Error("Test group key of likes failed")
+	}
+	//评论每条单独成组
+	if notifyGroupKey(NotifyComment, 1, "abc", 100) == notifyGroupKey(NotifyComment, 1, "abc", 200) {
+		t.Error("Test group key of comments failed")
+	}
+	if isNotifyType("unknown") {
+		t.Error("Test isNotifyType failed")
+	}
+}
+
+func TestNotifyDedupeKey(t *testing.T) {
+	//取关后重新关注是新的通知，同一个关注事件重复投递时去重
+	if notifyDedupeKey(NotifyFollow, 1, "", 100) == notifyDedupeKey(NotifyFollow, 1, "", 200) {
+		t.Error("Test dedupe key of follows failed")
+	}
+	if notifyDedupeKey(NotifyFollow, 1, "", 100) != notifyDedupeKey(NotifyFollow, 1, "", 100) {
+		t.Error("Test dedupe key of the same follow failed")
+	}
+	if notifyDedupeKey(NotifyLike, 1, "abc", 100) != notifyDedupeKey(NotifyLike, 1, "abc", 200) {
+		t.Error("Test dedupe key of likes failed")
+	}
+}
+
+func TestParseActors(t *testing.T) {
+	actors := parseActors("3,2,3,1,4", 3)
+	expected := []uint64{3, 2, 1}
+	if len(actors) != len(expected) {
+		t.Fatalf("expected: %v, got: %v", expected, actors)
+	}
+	for i := range expected {
+		if actors[i] != expected[i] {
+			t.Errorf("expected: %v, got: %v", expected, actors)
+		}
+	}
+}
+
+func TestUnreadTypeOf(t *testing.T) {
+	if unreadType, ok := unreadTypeOf(NotifyComment); !ok || unreadType != UnreadComment {
+		t.Errorf("Test unread type of comments failed, got: %v", unreadType)
+	}
+	if unreadType, ok := unreadTypeOf(NotifyMention); !ok || unreadType != UnreadMention {
+		t.Errorf("Test unread type of mentions failed, got: %v", unreadType)
+	}
+	if _, ok := unreadTypeOf(NotifyLike); ok {
+		t.Error("Test unread type of likes failed")
+	}
+}
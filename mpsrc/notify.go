@@ -0,0 +1,369 @@
+package mpsrc
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+* 实时通知：UNREAD、FRIENDSTIMELINE和NOTIFICATION的consumer只在持有分区的实例上执行，
+* 因此把未读数变化、新动态摘要和通知经redis的pub/sub频道（[notify]的Channel）广播给所有实例，
+* 每个实例再发布到进程内的hub；post类型的未读由每个实例各自查询本实例在线的用户中哪些是作者的粉丝。
+* hub按用户把事件分发给在线的SSE或长轮询连接，并为每个用户保留最近Backlog条事件，
+* 断线后客户端带上Last-Event-ID即可续传；用户的所有连接断开ResumeWindow后丢弃其事件。
+* 事件id取自纳秒时间（保证递增），因此换到其他实例续传时也能大致按时间对齐，
+* 无法补齐时下发reset事件，客户端重新拉取未读数即可
+ */
+const (
+	EventUnread       = "unread"
+	EventPost         = "post"
+	EventNotification = "notification"
+	EventReset        = "reset" //续传的位置已不在保留的事件内，客户端需要重新拉取未读数
+
+	NotifyPingInterval = time.Second //订阅连接的心跳，需要小于redis的读超时
+	NotifyRetryDelay   = time.Second //订阅断开后重新订阅的间隔
+)
+
+type NotifyEvent struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+//未读数变化，delta为1或-1，post类型的未读同时也是新动态的摘要
+type UnreadEvent struct {
+	Type      string `json:"type"`
+	Author    string `json:"author"`
+	Timestamp string `json:"timestamp"`
+	Delta     int    `json:"delta"`
+}
+
+//push到好友动态的新动态
+type PostEvent struct {
+	Author    uint64 `json:"author"`
+	Timestamp uint64 `json:"timestamp"`
+	ValueKey  string `json:"valuekey"`
+}
+
+//经redis广播给所有实例的事件
+type hubMessage struct {
+	Type   string          `json:"type"`
+	Users  []uint64        `json:"users,omitempty"`
+	FansOf string          `json:"fans_of,omitempty"` //分发给本实例在线的该作者的粉丝
+	Data   json.RawMessage `json:"data"`
+}
+
+type listener struct {
+	ch chan NotifyEvent
+}
+
+type userChannel struct {
+	subs      map[*listener]struct{}
+	events    []NotifyEvent
+	droppedID uint64 //超出Backlog被丢弃的最新事件id
+	idleSince time.Time
+}
+
+type notifyHub struct {
+	mu      sync.Mutex
+	users   map[string]*userChannel
+	lastID  uint64
+	backlog int
+	buffer  int
+}
+
+func newNotifyHub(backlog, buffer int) *notifyHub {
+	return &notifyHub{
+		users:   make(map[string]*userChannel),
+		backlog: backlog,
+		buffer:  buffer,
+	}
+}
+
+var hub = newNotifyHub(DEFAULT_NOTIFY_BACKLOG, DEFAULT_NOTIFY_BUFFER)
+
+//生成递增的事件id，需要持有锁
+func (h *notifyHub) nextID() uint64 {
+	id := uint64(time.Now().UnixNano())
+	if id <= h.lastID {
+		id = h.lastID + 1
+	}
+	h.lastID = id
+	return id
+}
+
+/*
+* 订阅用户的事件，返回lastID之后还保留着的事件以及当前最新的事件id，
+* lastID之后的事件无法补齐时，在返回的事件前加上一条reset事件
+ */
+func (h *notifyHub) subscribe(userID string, lastID uint64) (*listener, []NotifyEvent, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uc, ok := h.users[userID]
+	if !ok {
+		uc = &userChannel{subs: make(map[*listener]struct{})}
+		h.users[userID] = uc
+	}
+	sub := &listener{ch: make(chan NotifyEvent, h.buffer)}
+	uc.subs[sub] = struct{}{}
+
+	missed := make([]NotifyEvent, 0)
+	if lastID == 0 {
+		return sub, missed, h.lastID
+	}
+	//没有该用户的历史事件，或者续传位置之后的事件已被丢弃
+	if !ok || uc.droppedID > lastID {
+		missed = append(missed, NotifyEvent{Type: EventReset, Data: struct{}{}})
+	}
+	for _, event := range uc.events {
+		if event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed, h.lastID
+}
+
+func (h *notifyHub) unsubscribe(userID string, sub *listener) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uc, ok := h.users[userID]
+	if !ok {
+		return
+	}
+	delete(uc.subs, sub)
+	if len(uc.subs) == 0 {
+		uc.idleSince = time.Now()
+	}
+}
+
+/*
+* 发布事件，只保留和分发给在线（或还在续传窗口内）的用户；
+* 发送缓冲已满的连接会被关闭，客户端重连后通过Last-Event-ID补齐
+ */
+func (h *notifyHub) publish(userID, eventType string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uc, ok := h.users[userID]
+	if !ok {
+		return
+	}
+	event := NotifyEvent{ID: h.nextID(), Type: eventType, Data: data}
+	uc.events = append(uc.events, event)
+	if len(uc.events) > h.backlog {
+		uc.droppedID = uc.events[len(uc.events)-h.backlog-1].ID
+		uc.events = uc.events[len(uc.events)-h.backlog:]
+	}
+	for sub := range uc.subs {
+		select {
+		case sub.ch <- event:
+		default:
+			delete(uc.subs, sub)
+			close(sub.ch)
+			if len(uc.subs) == 0 {
+				uc.idleSince = time.Now()
+			}
+		}
+	}
+}
+
+//丢弃连接断开超过window的用户
+func (h *notifyHub) sweep(window time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for userID, uc := range h.users {
+		if len(uc.subs) == 0 && time.Since(uc.idleSince) > window {
+			delete(h.users, userID)
+		}
+	}
+}
+
+//在线（或还在续传窗口内）的用户
+func (h *notifyHub) online() []uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	users := make([]uint64, 0, len(h.users))
+	for userID := range h.users {
+		if uid, err := strconv.ParseUint(userID, 10, 64); err == nil {
+			users = append(users, uid)
+		}
+	}
+	return users
+}
+
+func (h *notifyHub) stats() (users, subs int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, uc := range h.users {
+		subs += len(uc.subs)
+	}
+	return len(h.users), subs
+}
+
+func runNotifySweep(nc *NotifyConfig) {
+	ticker := time.NewTicker(nc.ResumeWindow)
+	defer ticker.Stop()
+	for range ticker.C {
+		hub.sweep(nc.ResumeWindow)
+	}
+}
+
+func newHubMessage(eventType string, users []uint64, fansOf string, data interface{}) *hubMessage {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		mpLogger.Error(err, eventType)
+		return nil
+	}
+	return &hubMessage{Type: eventType, Users: users, FansOf: fansOf, Data: raw}
+}
+
+/*
+* 把事件广播给所有实例，用一个pipeline发布；
+* redis不可用时只发布到本实例的hub
+ */
+func broadcast(msgs ...*hubMessage) {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		mpLogger.Error(ErrNilRedisConn)
+		deliverLocal(msgs)
+		return
+	}
+	defer conn.Close()
+	for _, msg := range msgs {
+		if msg == nil {
+			continue
+		}
+		value, err := json.Marshal(msg)
+		if err != nil {
+			mpLogger.Error(err, msg.Type)
+			continue
+		}
+		conn.Send("PUBLISH", config.Notify.Channel, value)
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err == nil {
+		err = replyError(replies)
+	}
+	if err != nil {
+		mpLogger.Error(err, config.Notify.Channel)
+		deliverLocal(msgs)
+	}
+}
+
+func deliverLocal(msgs []*hubMessage) {
+	for _, msg := range msgs {
+		if msg != nil {
+			deliver(msg)
+		}
+	}
+}
+
+/*
+* 把广播的事件发布到本实例的hub，不在本实例的用户被hub忽略；
+* FansOf不为空时只按主键查询本实例在线的用户中哪些是作者的粉丝，不读取完整的粉丝列表
+ */
+func deliver(msg *hubMessage) {
+	receivers := msg.Users
+	if msg.FansOf != "" {
+		online := hub.online()
+		if len(online) == 0 {
+			return
+		}
+		author, err := strconv.ParseUint(msg.FansOf, 10, 64)
+		if err != nil {
+			return
+		}
+		fans, err := filterFansOfDB(author, online)
+		if err != nil {
+			mpLogger.Warn(err, msg.FansOf)
+			return
+		}
+		receivers = fans
+	}
+	for _, receiver := range receivers {
+		hub.publish(strconv.FormatUint(receiver, 10), msg.Type, msg.Data)
+	}
+}
+
+//订阅广播频道直到连接出错，定期ping避免连接因读超时断开
+func subscribeNotify(channel string) error {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return ErrNilRedisConn
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+	if err := psc.Subscribe(channel); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer wg.Wait()
+	defer close(done)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(NotifyPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var msg hubMessage
+			if err := json.Unmarshal(v.Data, &msg); err != nil {
+				mpLogger.Warn(err, channel)
+				continue
+			}
+			deliver(&msg)
+		case error:
+			return v
+		}
+	}
+}
+
+//订阅断开时重新订阅，断开期间的事件由客户端通过reset补齐
+func runNotifyFeed(nc *NotifyConfig) {
+	for {
+		if err := subscribeNotify(nc.Channel); err != nil {
+			mpLogger.Warn(err, nc.Channel)
+		}
+		time.Sleep(NotifyRetryDelay)
+	}
+}
+
+//通知接收者未读数的变化，post类型的未读通知作者在线的粉丝（包括不在push集合内的）
+func notifyUnread(opt, unreadType, author, ts string, receivers []uint64) {
+	event := UnreadEvent{Type: unreadType, Author: author, Timestamp: ts, Delta: 1}
+	if opt == "decrease" {
+		event.Delta = -1
+	}
+	if unreadType == UnreadPost {
+		broadcast(newHubMessage(EventUnread, nil, author, event))
+		return
+	}
+	broadcast(newHubMessage(EventUnread, receivers, "", event))
+}
+
+//push过来的新动态，多条时一起广播
+func postMessage(userID, author, ts uint64, valueKey string) *hubMessage {
+	return newHubMessage(EventPost, []uint64{userID}, "", PostEvent{Author: author, Timestamp: ts, ValueKey: valueKey})
+}
+
+//通知粉丝push过来的新动态
+func notifyPost(userID, author, ts uint64, valueKey string) {
+	broadcast(postMessage(userID, author, ts, valueKey))
+}
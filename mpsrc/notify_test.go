@@ -0,0 +1,87 @@
+package mpsrc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNotifyHubResume(t *testing.T) {
+	h := newNotifyHub(3, 2)
+	//没有连接的用户不保留事件
+	h.publish("1", EventUnread, nil)
+	sub, missed, _ := h.subscribe("1", 0)
+	if len(missed) != 0 {
+		t.Errorf("expected: %v, got: %v", 0, len(missed))
+	}
+	h.publish("1", EventUnread, nil)
+	first := <-sub.ch
+	h.unsubscribe("1", sub)
+
+	h.publish("1", EventPost, nil)
+	h.publish("1", EventPost, nil)
+	_, missed, cursor := h.subscribe("1", first.ID)
+	if len(missed) != 2 || missed[1].ID != cursor {
+		t.Errorf("Test resume failed, got %+v", missed)
+	}
+
+	//续传位置之后的事件已超出Backlog
+	h.publish("1", EventPost, nil)
+	h.publish("1", EventPost, nil)
+	_, missed, _ = h.subscribe("1", first.ID)
+	if len(missed) != 4 || missed[0].Type != EventReset {
+		t.Errorf("Test resume after drop failed, got %+v", missed)
+	}
+}
+
+func TestNotifyHubSlowSubscriber(t *testing.T) {
+	h := newNotifyHub(8, 1)
+	sub, _, _ := h.subscribe("1", 0)
+	h.publish("1", EventUnread, nil)
+	h.publish("1", EventUnread, nil)
+	<-sub.ch
+	if _, ok := <-sub.ch; ok {
+		t.Error("Test slow subscriber failed, channel should be closed")
+	}
+	if _, subs := h.stats(); subs != 0 {
+		t.Errorf("expected: %v, got: %v", 0, subs)
+	}
+}
+
+func TestNotifyHubOnline(t *testing.T) {
+	h := newNotifyHub(8, 1)
+	if online := h.online(); len(online) != 0 {
+		t.Errorf("expected no online users, got: %v", online)
+	}
+	h.subscribe("1", 0)
+	sub, _, _ := h.subscribe("2", 0)
+	//断开后还在续传窗口内
+	h.unsubscribe("2", sub)
+	if online := h.online(); len(online) != 2 {
+		t.Errorf("expected: %v, got: %v", 2, online)
+	}
+}
+
+func TestDeliverHubMessage(t *testing.T) {
+	old := hub
+	defer func() { hub = old }()
+	hub = newNotifyHub(8, 4)
+
+	//广播的事件只发布给本实例的用户
+	sub, _, _ := hub.subscribe("1", 0)
+	value, _ := json.Marshal(postMessage(1, 2, 100, "abc"))
+	var msg hubMessage
+	if err := json.Unmarshal(value, &msg); err != nil {
+		t.Fatal(err)
+	}
+	deliver(&msg)
+	deliver(postMessage(3, 2, 100, "abc"))
+
+	event := <-sub.ch
+	data, _ := json.Marshal(event.Data)
+	if event.Type != EventPost || string(data) != `{"author":2,"timestamp":100,"valuekey":"abc"}` {
+		t.Errorf("unexpected event: %v %s", event.Type, data)
+	}
+	if users, _ := hub.stats(); users != 1 {
+		t.Errorf("expected: %v, got: %v", 1, users)
+	}
+}
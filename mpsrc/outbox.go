@@ -0,0 +1,281 @@
+package mpsrc
+
+import (
+	"feed/mq"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+* 事务性outbox：配置[outbox]的Enabled时，发布、删除动态和关注关系的主表写入与它产生的事件在同一个mysql事务内，
+* 事件先写入outbox表，由relay按id顺序同步放入队列后标记为已发送，队列不可用时写入仍然成功，事件在队列恢复后发出，
+* 主表和事件流不会不一致。consumer照常处理这些事件（写入都是upsert）；
+* 多个实例中只有持有relay租约的一个发送，租约过期切换时可能重复发送同一个事件，由consumer按事件id去重；
+* 发送失败的事件按退避重试，期间阻塞之后的事件以保持顺序，消息被队列拒绝或者失败MaxAttempts次后搁置（sent=2），
+* 不再阻塞之后的事件，admin的POST /outbox/requeue将搁置的事件放回
+ */
+type OutboxEvent struct {
+	ID       uint64
+	Topic    string
+	Key      string
+	Value    string
+	Attempts int
+	RetryAt  int64 // 下次发送的时间(ms)
+}
+
+type OutboxStats struct {
+	Pending int64 `json:"pending"`
+	Parked  int64 `json:"parked"`
+	Sent    int64 `json:"sent"`
+	Failed  int64 `json:"failed"`
+}
+
+const (
+	OutboxPending = 0
+	OutboxSent    = 1
+	OutboxParked  = 2
+
+	OutboxRelay      = "outboxrelay"
+	MaxOutboxBackoff = time.Minute
+)
+
+var (
+	outboxStmt = &batchStmt{head: "insert into outbox(topic, msgkey, value, ts) values ", row: "(?,?,?,?)", sep: ","}
+
+	outboxSent   int64
+	outboxFailed int64
+)
+
+//主表的行和事件一起缓冲，flush时在一个事务内写入
+type outboxWriter struct {
+	*batchWriter
+}
+
+func newOutboxWriter() *outboxWriter {
+	return &outboxWriter{newBatchWriter()}
+}
+
+//与publishEvent相同，但事件写入outbox表
+func (w *outboxWriter) publish(topic, key string, payload interface{}, publishedAt time.Time, trace Trace) (*Envelope, error) {
+	env, value, err := newEnvelope(topic, payload, publishedAt, trace)
+	if err != nil {
+		mpLogger.Error(err, topic, key)
+		return nil, err
+	}
+	w.add(outboxStmt, topic, key, string(value), time.Now().Unix())
+	return env, nil
+}
+
+//发布动态：value、个人动态以及push、未读数的事件
+func addPersonalTimelineWithOutbox(userID, ts, value string) error {
+	uid, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	timestamp, err := strconv.ParseUint(ts, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	valueKey := valueKeyOf(value, userID)
+	publishedAt := time.Now()
+	w := newOutboxWriter()
+	w.add(upsertStmt("valuestore", "valuekey, value", "(?,?)", "value=values(value)"), valueKey, value)
+	w.add(upsertStmt(personalTimelineTable(uid), "uid, ts, valuekey", "(?,?,?)", "ts=ts"), uid, timestamp, valueKey)
+	if _, err := w.publish(ADDVALUE, valueKey, &ValueEvent{Key: valueKey, Value: value}, publishedAt, Trace{}); err != nil {
+		return err
+	}
+	event := &TimelineEvent{UserID: uid, Timestamp: timestamp, ValueKey: valueKey}
+	env, err := w.publish(ADDPERSONALTIMELINE, userID, event, publishedAt, Trace{})
+	if err != nil {
+		return err
+	}
+	if _, err := w.publish(UNREAD, userID, &UnreadChangeEvent{Op: "increase", Author: uid, Timestamp: timestamp, Type: UnreadPost},
+		publishedAt, env.child()); err != nil {
+		return err
+	}
+	pullOnly := isPullOnly()
+	if !pullOnly {
+		for _, fan := range getPushFans(userID) {
+			if _, err := w.publish(FRIENDSTIMELINE, strconv.FormatUint(fan, 10), &PushEvent{
+				UserID:    fan,
+				Author:    uid,
+				Timestamp: timestamp,
+				ValueKey:  valueKey,
+			}, publishedAt, env.child()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	recordWrite(userID, sessionPosts, postField(timestamp), &pendingWrite{ID: env.ID, Op: sessionAdd, Timestamp: timestamp, ValueKey: valueKey, Value: value})
+	//写入过载时不push，由粉丝主动pull
+	if pullOnly {
+		markPullOnly(userID, ts)
+	}
+	return nil
+}
+
+//删除动态：个人动态、value以及未读数的事件
+func delPersonalTimelineWithOutbox(uid, timestamp uint64, userID, value string) error {
+	publishedAt := time.Now()
+	w := newOutboxWriter()
+	w.add(deleteStmt(personalTimelineTable(uid), "uid=? and ts=?"), uid, timestamp)
+	w.add(deleteStmt("valuestore", "value=?"), value)
+	env, err := w.publish(DELPERSONALTIMELINE, userID, &TimelineEvent{UserID: uid, Timestamp: timestamp}, publishedAt, Trace{})
+	if err != nil {
+		return err
+	}
+	if _, err := w.publish(UNREAD, userID, &UnreadChangeEvent{Op: "decrease", Author: uid, Timestamp: timestamp, Type: UnreadPost},
+		publishedAt, env.child()); err != nil {
+		return err
+	}
+	if _, err := w.publish(DELVALUE, value, &ValueEvent{Key: value}, publishedAt, env.child()); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	recordWrite(userID, sessionPosts, postField(timestamp), &pendingWrite{ID: env.ID, Op: sessionDelete, Timestamp: timestamp})
+	return nil
+}
+
+//关注关系：粉丝列表或关注列表，以及关注时给对方的通知
+func updateFriendsInfoWithOutbox(event *RelationEvent, userID, infoType, opt string) (*Envelope, error) {
+	var topic, table, vt string
+	switch {
+	case infoType == FANS && opt == "add":
+		topic, table, vt = ADDFANS, "fanslist", "fid"
+	case infoType == FANS && opt == "delete":
+		topic, table, vt = DELFANS, "fanslist", "fid"
+	case infoType == LIKES && opt == "add":
+		topic, table, vt = ADDLIKES, "likeslist", "lid"
+	case infoType == LIKES && opt == "delete":
+		topic, table, vt = DELLIKES, "likeslist", "lid"
+	default:
+		return nil, ErrOpt
+	}
+	now := time.Now()
+	w := newOutboxWriter()
+	if opt == "add" {
+		w.add(upsertStmt(table, "uid, "+vt+", ts", "(?,?,now())", "ts=ts"), event.UserID, event.TargetID)
+	} else {
+		w.add(deleteStmt(table, "uid=? and "+vt+"=?"), event.UserID, event.TargetID)
+		w.add(deleteStmt("pushfriendstimeline", "uid=? and lid=?"), event.UserID, event.TargetID)
+	}
+	env, err := w.publish(topic, userID, event, now, Trace{})
+	if err != nil {
+		return nil, err
+	}
+	//通知被关注的用户
+	if topic == ADDLIKES && event.UserID != event.TargetID {
+		if _, err := w.publish(NOTIFICATION, strconv.FormatUint(event.TargetID, 10), &NotificationEvent{
+			Receiver:  event.TargetID,
+			Type:      NotifyFollow,
+			Actor:     event.UserID,
+			Timestamp: uint64(now.Unix()),
+		}, now, env.child()); err != nil {
+			return nil, err
+		}
+	}
+	return env, w.flush()
+}
+
+//第attempts次失败后的等待时间，从Interval开始翻倍
+func outboxBackoff(interval time.Duration, attempts int) time.Duration {
+	backoff := interval
+	for i := 1; i < attempts && backoff < MaxOutboxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxOutboxBackoff {
+		backoff = MaxOutboxBackoff
+	}
+	return backoff
+}
+
+/*
+* 按id顺序同步发送一批未发送的事件，遇到发送失败或者还在退避的事件时停止以保持顺序，
+* 搁置的事件跳过继续发送，返回处理（发送或搁置）的条数
+ */
+func relayOutbox(oc *OutboxConfig) (int, error) {
+	events, err := getOutboxFromDB(oc.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	ids := make([]uint64, 0, len(events))
+	parked := 0
+	for _, e := range events {
+		if e.RetryAt > now.UnixNano()/int64(time.Millisecond) {
+			break
+		}
+		perr := publishSync(e.Topic, e.Key, e.Value)
+		if perr == nil {
+			ids = append(ids, e.ID)
+			continue
+		}
+		atomic.AddInt64(&outboxFailed, 1)
+		mpLogger.Error(perr, e.ID, e.Topic, e.Key, e.Attempts+1)
+		park := mq.Rejected(perr) || e.Attempts+1 >= oc.MaxAttempts
+		retryAt := now.Add(outboxBackoff(oc.Interval, e.Attempts+1)).UnixNano() / int64(time.Millisecond)
+		if err = failOutboxOfDB(e.ID, retryAt, park); err != nil || !park {
+			err = perr
+			break
+		}
+		parked++
+	}
+	if len(ids) > 0 {
+		if merr := markOutboxSentOfDB(ids); merr != nil {
+			//已发送但没有标记的事件会被再次发送，由consumer去重
+			return parked, merr
+		}
+		atomic.AddInt64(&outboxSent, int64(len(ids)))
+	}
+	return len(ids) + parked, err
+}
+
+/*
+* 周期性地发送outbox中的事件，只有持有relay租约的实例发送，一批发满时立即继续，
+* 并清理超过Retention的已发送事件
+ */
+func runOutboxRelay(oc *OutboxConfig) {
+	ticker := time.NewTicker(oc.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			//每批之前续期，发送一批的时间不能超过租约
+			if held, err := acquireLease(OutboxRelay, oc.Lease); !held {
+				if err != nil {
+					mpLogger.Warn(err)
+				}
+				break
+			}
+			n, err := relayOutbox(oc)
+			if err != nil || n < oc.BatchSize {
+				break
+			}
+		}
+		if _, err := purgeOutboxOfDB(time.Now().Add(-oc.Retention).Unix(), oc.BatchSize); err != nil {
+			mpLogger.Warn(err)
+		}
+	}
+}
+
+func getOutboxStats() *OutboxStats {
+	stats := &OutboxStats{
+		Sent:   atomic.LoadInt64(&outboxSent),
+		Failed: atomic.LoadInt64(&outboxFailed),
+	}
+	pending, err := countOutboxOfDB(OutboxPending)
+	if err != nil {
+		pending = -1
+	}
+	parked, err := countOutboxOfDB(OutboxParked)
+	if err != nil {
+		parked = -1
+	}
+	stats.Pending, stats.Parked = pending, parked
+	return stats
+}
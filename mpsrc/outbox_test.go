@@ -0,0 +1,44 @@
+package mpsrc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOutboxWriter(t *testing.T) {
+	w := newOutboxWriter()
+	w.add(upsertStmt("likeslist", "uid, lid, ts", "(?,?,now())", "ts=ts"), 1, 2)
+	env, err := w.publish(ADDLIKES, "1", &RelationEvent{UserID: 1, TargetID: 2}, time.Now(), Trace{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.publish(NOTIFICATION, "2", &NotificationEvent{Receiver: 2, Type: NotifyFollow, Actor: 1}, time.Now(), env.child())
+
+	//主表在前，事件按发布顺序合并为一条insert
+	if len(w.order) != 2 {
+		t.Fatalf("expected 2 statements, got: %d", len(w.order))
+	}
+	expected := "insert into outbox(topic, msgkey, value, ts) values (?,?,?,?),(?,?,?,?)"
+	if q := w.query(w.order[1]); q != expected {
+		t.Errorf("expected: %v, got: %v", expected, q)
+	}
+	args := w.args[w.order[1]]
+	if args[0] != ADDLIKES || args[1] != "1" || args[4] != NOTIFICATION {
+		t.Errorf("unexpected args: %v", args)
+	}
+	var stored Envelope
+	if err := json.Unmarshal([]byte(args[2].(string)), &stored); err != nil || stored.ID != env.ID {
+		t.Errorf("expected envelope %v, got: %+v %v", env.ID, stored, err)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	interval := 200 * time.Millisecond
+	cases := map[int]time.Duration{1: interval, 2: 2 * interval, 4: 8 * interval, 20: MaxOutboxBackoff}
+	for attempts, expected := range cases {
+		if got := outboxBackoff(interval, attempts); got != expected {
+			t.Errorf("attempts %d expected: %v, got: %v", attempts, expected, got)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package mpsrc
+
+import (
+	"encoding/json"
+	"flag"
+	"feed/mq"
+	"fmt"
+	mtlog "gitlab.meitu.com/platform/gocommons/log"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+* 重放：修复bug之后从kafka读取一段事件，经过与线上consumer相同的handler重新处理，重建派生的数据（收件箱、未读数、缓存等）；
+* 不加入消费组，不影响线上consumer的offset，也不经过去重（已处理的事件同样会重新处理），失败的事件只记录日志不放入死信队列。
+* mysql的写入都是upsert，可以重复执行；UNREAD的increase/decrease和NOTIFICATION是累加的，重放前需要先清理对应的数据。
+*   feed replay -c conf/feed-for-test.toml -topics addfans,delfans -from 2018-01-02T15:04:05+08:00 -to newest -user 123 -dry-run
+ */
+type replayOptions struct {
+	topics []string
+	r      mq.Range
+	user   string   // 不为空时只重放key为该用户id（value为value key）的事件
+	types  []string // 不为空时只重放这些类型的事件
+	dryRun bool     // 只输出匹配的事件，不处理
+	rate   int      // 每秒最多处理的事件数，0不限制
+	out    io.Writer
+}
+
+type replayStats struct {
+	Read    int64
+	Matched int64
+	Applied int64
+	Failed  int64
+}
+
+//解析重放的位置：oldest、newest、offset或者RFC3339格式的时间
+func parseReplayPosition(s string) (int64, time.Time, error) {
+	switch s {
+	case OffsetOldest:
+		return mq.OffsetOldest, time.Time{}, nil
+	case OffsetNewest:
+		return mq.OffsetNewest, time.Time{}, nil
+	}
+	if offset, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if offset < 0 {
+			return 0, time.Time{}, ErrOffset
+		}
+		return offset, time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, time.Time{}, ErrReplayPosition
+	}
+	return 0, t, nil
+}
+
+//事件的类型，旧格式的消息为所在的topic
+func eventType(msg *mq.Message) string {
+	var env struct {
+		Type string `json:"type"`
+	}
+	if len(msg.Value) > 0 && msg.Value[0] == '{' && json.Unmarshal(msg.Value, &env) == nil && env.Type != "" {
+		return env.Type
+	}
+	return msg.Topic
+}
+
+func (o *replayOptions) match(msg *mq.Message) bool {
+	if o.user != "" && string(msg.Key) != o.user {
+		return false
+	}
+	if len(o.types) == 0 {
+		return true
+	}
+	t := eventType(msg)
+	for _, typ := range o.types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+//按topic顺序重放，同一分区内按offset顺序处理，同一用户的事件保持顺序
+func replay(reader mq.Reader, o *replayOptions) (*replayStats, error) {
+	var tick <-chan time.Time
+	if o.rate > 0 && !o.dryRun {
+		ticker := time.NewTicker(time.Second / time.Duration(o.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	stats := &replayStats{}
+	for _, topic := range o.topics {
+		handler, ok := topicHandlers[topic]
+		if !ok {
+			return stats, ErrTopic
+		}
+		if !o.dryRun {
+			handler = mq.WithRetry(handler, retryPolicy(), nil)
+		}
+		err := reader.ReadRange(topic, o.r, func(msg *mq.Message) error {
+			stats.Read++
+			if !o.match(msg) {
+				return nil
+			}
+			stats.Matched++
+			if o.dryRun {
+				fmt.Fprintf(o.out, "%s\t%d\t%d\t%s\t%s\t%s\n", msg.Topic, msg.Partition, msg.Offset,
+					msg.Timestamp.Format(time.RFC3339), msg.Key, msg.Value)
+				return nil
+			}
+			if tick != nil {
+				<-tick
+			}
+			if err := handler(msg); err != nil {
+				stats.Failed++
+				mpLogger.Error(err, msg.Topic, msg.Partition, msg.Offset, string(msg.Key))
+				return nil
+			}
+			stats.Applied++
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+//feed replay子命令，返回进程的退出码：参数错误为2，失败为1，被中断为130
+func replayMain(args []string) int {
+	var (
+		conf, topics, from, to, types string
+		o                             = &replayOptions{out: os.Stdout}
+		partition                     int
+	)
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&conf, "c", DEFAULT_CONF, "conf file path")
+	fs.StringVar(&topics, "topics", "", "topics to replay, separated by comma")
+	fs.IntVar(&partition, "partition", int(mq.AllPartitions), "partition to replay, -1 for all")
+	fs.StringVar(&from, "from", OffsetOldest, "start position: oldest, newest, offset or RFC3339 time")
+	fs.StringVar(&to, "to", OffsetNewest, "end position (exclusive): oldest, newest, offset or RFC3339 time")
+	fs.StringVar(&o.user, "user", "", "only replay events of this user id")
+	fs.StringVar(&types, "types", "", "only replay events of these types, separated by comma")
+	fs.BoolVar(&o.dryRun, "dry-run", false, "print matched events without applying them")
+	fs.IntVar(&o.rate, "rate", DEFAULT_REPLAY_RATE, "max events applied per second, 0 for unlimited")
+	fs.Parse(args)
+
+	if topics == "" {
+		fmt.Println("topics is required")
+		return 2
+	}
+	//限速的间隔为1s/rate，超过每秒1e9个时间隔为0
+	if o.rate < 0 || o.rate > int(time.Second) {
+		fmt.Println("invalid rate:", o.rate)
+		return 2
+	}
+	o.topics = strings.Split(topics, ",")
+	if types != "" {
+		o.types = strings.Split(types, ",")
+	}
+	o.r.Partition = int32(partition)
+	var err error
+	if o.r.Start, o.r.StartTime, err = parseReplayPosition(from); err != nil {
+		fmt.Println("invalid from:", err)
+		return 2
+	}
+	if o.r.End, o.r.EndTime, err = parseReplayPosition(to); err != nil {
+		fmt.Println("invalid to:", err)
+		return 2
+	}
+
+	if config, err = loadConfig(conf); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	//内存队列只在进程内，没有可以重放的事件
+	if config.Kafka.Driver == MQMemory {
+		fmt.Println(ErrReplayDriver)
+		return 1
+	}
+	if mpLogger, err = mtlog.CreateSeelogger("feed"); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return 1
+	}
+	if !o.dryRun {
+		setMysqlPool()
+		setupRedisPool()
+		setupMemcacheStorage()
+		setupStorageProxy()
+		//NOTIFICATION等handler会发布后续的事件
+		setupQueue()
+		defer stopKafka()
+	}
+	reader, err := mq.NewKafkaReader([]string{config.Kafka.Addr}, mqOptions())
+	if err != nil {
+		fmt.Println("Setup kafka reader failed", err)
+		return 1
+	}
+
+	//中断时停止读取，已经处理的事件不会回滚
+	var interrupted int32
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		atomic.StoreInt32(&interrupted, 1)
+		reader.Close()
+	}()
+
+	stats, err := replay(reader, o)
+	reader.Close()
+	fmt.Printf("read %d, matched %d, applied %d, failed %d\n", stats.Read, stats.Matched, stats.Applied, stats.Failed)
+	//中断后读取可能正常结束，需要明确提示只重放了一部分
+	if atomic.LoadInt32(&interrupted) == 1 {
+		fmt.Println("replay interrupted, only part of the range was replayed")
+		return 130
+	}
+	if err != nil {
+		fmt.Println("replay stopped:", err)
+		return 1
+	}
+	if stats.Failed > 0 {
+		return 1
+	}
+	return 0
+}
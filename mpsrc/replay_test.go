@@ -0,0 +1,71 @@
+package mpsrc
+
+import (
+	"bytes"
+	"feed/mq"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReplayPosition(t *testing.T) {
+	if offset, _, err := parseReplayPosition("oldest"); err != nil || offset != mq.OffsetOldest {
+		t.Errorf("expected oldest, got: %d %v", offset, err)
+	}
+	if offset, _, err := parseReplayPosition("42"); err != nil || offset != 42 {
+		t.Errorf("expected 42, got: %d %v", offset, err)
+	}
+	if _, ts, err := parseReplayPosition("2018-01-02T15:04:05+08:00"); err != nil || ts.Unix() != 1514876645 {
+		t.Errorf("unexpected time: %v %v", ts, err)
+	}
+	if _, _, err := parseReplayPosition("-1"); err != ErrOffset {
+		t.Errorf("expected: %v, got: %v", ErrOffset, err)
+	}
+	if _, _, err := parseReplayPosition("yesterday"); err != ErrReplayPosition {
+		t.Errorf("expected: %v, got: %v", ErrReplayPosition, err)
+	}
+}
+
+func TestReplayDryRun(t *testing.T) {
+	broker := mq.NewMemoryBroker(2, 0, nil)
+	defer broker.Close()
+	for _, e := range []RelationEvent{{UserID: 1, TargetID: 2}, {UserID: 3, TargetID: 4}, {UserID: 1, TargetID: 5}} {
+		_, value, err := newEnvelope(ADDFANS, &e, time.Now(), Trace{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		broker.Publish(&mq.Message{Topic: ADDFANS, Key: []byte(strconv.FormatUint(e.UserID, 10)), Value: value})
+	}
+	//旧格式的消息按topic作为类型
+	broker.Publish(&mq.Message{Topic: ADDFANS, Key: []byte("1"), Value: []byte("6")})
+
+	var out bytes.Buffer
+	o := &replayOptions{
+		topics: []string{ADDFANS},
+		r:      mq.Range{Partition: mq.AllPartitions, Start: mq.OffsetOldest, End: mq.OffsetNewest},
+		user:   "1",
+		types:  []string{ADDFANS},
+		dryRun: true,
+		out:    &out,
+	}
+	stats, err := replay(broker, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Read != 4 || stats.Matched != 3 || stats.Applied != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 lines, got: %d", lines)
+	}
+
+	o.types = []string{DELFANS}
+	if stats, _ := replay(broker, o); stats.Matched != 0 {
+		t.Errorf("expected no match, got: %+v", stats)
+	}
+	o.topics = []string{"unknown"}
+	if _, err := replay(broker, o); err != ErrTopic {
+		t.Errorf("expected: %v, got: %v", ErrTopic, err)
+	}
+}
@@ -0,0 +1,226 @@
+package mpsrc
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+/*
+* pushfriendstimeline的保留策略：按条数和/或时间裁剪每个用户的inbox，
+* 按uid顺序（主键的前缀）分批执行，批次之间按配置限流；
+* 多实例部署时只有持有retention租约的实例执行，每批续期，租约丢失时停止本轮
+ */
+const (
+	RetentionLease       = "retention"
+	RetentionLeaseTime   = time.Minute
+	RetentionDeleteBatch = 500 //按条数裁剪时每次删除的最大行数
+)
+
+type RetentionStats struct {
+	Running      bool   `json:"running"`
+	Rounds       uint64 `json:"rounds"`
+	StartedAt    int64  `json:"started_at"`
+	FinishedAt   int64  `json:"finished_at"`
+	LastUID      uint64 `json:"last_uid"`
+	Users        uint64 `json:"users"`
+	Deleted      int64  `json:"deleted"` // 本轮删除的行数
+	TotalDeleted int64  `json:"total_deleted"`
+}
+
+//inbox中的一行，按ts、lid、valuekey倒序排名
+type inboxRow struct {
+	LID      uint64
+	TS       uint64
+	ValueKey string
+}
+
+var (
+	retentionMu      sync.Mutex
+	retentionStats   = RetentionStats{}
+	retentionTrigger = make(chan bool, 1)
+
+	inboxRowStmt = deleteStmt("pushfriendstimeline", "uid=? and lid=? and ts=? and valuekey=?")
+)
+
+//返回当前清理进度的拷贝，供admin server输出
+func getRetentionStats() RetentionStats {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	return retentionStats
+}
+
+//立即触发一轮清理，已有等待中的触发时返回false
+func triggerRetention() bool {
+	select {
+	case retentionTrigger <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+//取出uid大于lastUID的一批用户
+func getInboxUsers(client *sql.DB, lastUID uint64, limit int) ([]uint64, error) {
+	rows, err := client.Query("select distinct uid from pushfriendstimeline where uid > ? order by uid limit ?", lastUID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uid uint64
+	uids := make([]uint64, 0, limit)
+	for rows.Next() {
+		if err = rows.Scan(&uid); err != nil {
+			return uids, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+//排在前skip条之后的最多limit行，同一时间的动态按lid、valuekey排名，保证正好保留skip条
+func getInboxOverflow(client *sql.DB, uid uint64, skip, limit int) ([]inboxRow, error) {
+	rows, err := client.Query("select lid, ts, valuekey from pushfriendstimeline where uid=? order by ts desc, lid desc, valuekey desc limit ?, ?",
+		uid, skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overflow := make([]inboxRow, 0, limit)
+	for rows.Next() {
+		var r inboxRow
+		if err = rows.Scan(&r.LID, &r.TS, &r.ValueKey); err != nil {
+			return overflow, err
+		}
+		overflow = append(overflow, r)
+	}
+	return overflow, rows.Err()
+}
+
+//按主键删除指定的行
+func trimInboxWriter(uid uint64, rows []inboxRow) *batchWriter {
+	w := newBatchWriter()
+	for _, r := range rows {
+		w.add(inboxRowStmt, uid, r.LID, r.TS, r.ValueKey)
+	}
+	return w
+}
+
+//按时间和条数裁剪单个用户的inbox，返回删除的行数
+func trimInbox(client *sql.DB, uid uint64, rc *RetentionConfig) (int64, error) {
+	var deleted int64
+	if rc.MaxAge > 0 {
+		cutoff := time.Now().Unix() - rc.MaxAge
+		rs, err := client.Exec("delete from pushfriendstimeline where uid=? and ts<?", uid, cutoff)
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := rs.RowsAffected()
+		deleted += n
+	}
+	if rc.MaxCount > 0 {
+		//按排名删除第MaxCount条之后的行，时间相同的动态不会多删
+		for {
+			rows, err := getInboxOverflow(client, uid, rc.MaxCount, RetentionDeleteBatch)
+			if err != nil || len(rows) == 0 {
+				return deleted, err
+			}
+			if err := trimInboxWriter(uid, rows).flush(); err != nil {
+				return deleted, err
+			}
+			deleted += int64(len(rows))
+			if len(rows) < RetentionDeleteBatch {
+				break
+			}
+		}
+	}
+	return deleted, nil
+}
+
+//按uid顺序清理所有用户，每处理完一批用户更新进度、续期租约并休眠Throttle
+func trimInboxes(rc *RetentionConfig) {
+	for {
+		if held, err := acquireLease(RetentionLease, RetentionLeaseTime); !held {
+			mpLogger.Warn("retention lease lost", err)
+			return
+		}
+		client := mysqlPool.GetClient(true)
+		if client == nil {
+			mpLogger.Error(ErrAllMysqlDown)
+			return
+		}
+		retentionMu.Lock()
+		lastUID := retentionStats.LastUID
+		retentionMu.Unlock()
+
+		uids, err := getInboxUsers(client, lastUID, rc.BatchSize)
+		if err != nil {
+			mpLogger.Warn(err)
+			return
+		}
+		var deleted int64
+		for _, uid := range uids {
+			n, err := trimInbox(client, uid, rc)
+			if err != nil {
+				mpLogger.Warn(err, uid)
+			}
+			deleted += n
+		}
+
+		retentionMu.Lock()
+		if len(uids) > 0 {
+			retentionStats.LastUID = uids[len(uids)-1]
+		}
+		retentionStats.Users += uint64(len(uids))
+		retentionStats.Deleted += deleted
+		retentionStats.TotalDeleted += deleted
+		retentionMu.Unlock()
+
+		if len(uids) < rc.BatchSize {
+			return
+		}
+		time.Sleep(rc.Throttle)
+	}
+}
+
+func runRetentionRound(rc *RetentionConfig) {
+	//其他实例正在执行
+	if held, err := acquireLease(RetentionLease, RetentionLeaseTime); !held {
+		if err != nil {
+			mpLogger.Warn(err)
+		}
+		return
+	}
+	retentionMu.Lock()
+	retentionStats.Running = true
+	retentionStats.StartedAt = time.Now().Unix()
+	retentionStats.LastUID, retentionStats.Users, retentionStats.Deleted = 0, 0, 0
+	retentionMu.Unlock()
+
+	trimInboxes(rc)
+
+	retentionMu.Lock()
+	retentionStats.Running = false
+	retentionStats.Rounds++
+	retentionStats.FinishedAt = time.Now().Unix()
+	total := retentionStats.TotalDeleted
+	retentionMu.Unlock()
+	mpLogger.Info("retention round finished, total deleted: ", total)
+}
+
+/*
+* 周期性地执行inbox清理，也可以通过admin server手动触发
+ */
+func runRetention(rc *RetentionConfig) {
+	ticker := time.NewTicker(rc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-retentionTrigger:
+		}
+		runRetentionRound(rc)
+	}
+}
@@ -0,0 +1,24 @@
+package mpsrc
+
+import (
+	"testing"
+)
+
+func TestTrimInboxWriter(t *testing.T) {
+	//同一时间的两条动态按主键分别删除，只删排名在MaxCount之后的那条
+	w := trimInboxWriter(1, []inboxRow{{LID: 3, TS: 100, ValueKey: "a"}, {LID: 2, TS: 100, ValueKey: "b"}})
+	if len(w.order) != 1 {
+		t.Fatalf("expected 1 statement, got: %d", len(w.order))
+	}
+	expected := "delete from pushfriendstimeline where (uid=? and lid=? and ts=? and valuekey=?) or (uid=? and lid=? and ts=? and valuekey=?)"
+	if q := w.query(w.order[0]); q != expected {
+		t.Errorf("expected: %v, got: %v", expected, q)
+	}
+	args := w.args[w.order[0]]
+	if len(args) != 8 || args[1] != uint64(3) || args[3] != "a" || args[5] != uint64(2) || args[7] != "b" {
+		t.Errorf("unexpected args: %v", args)
+	}
+	if w := trimInboxWriter(1, nil); len(w.order) != 0 {
+		t.Errorf("expected nothing to delete, got: %v", w.order)
+	}
+}
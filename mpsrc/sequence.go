@@ -0,0 +1,143 @@
+package mpsrc
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+* pull作者的未读数：作者每发布一条动态递增自己的序号（PostSeq），
+* 读者在SeqSeen中记录每个关注对象已读到的序号，未读数为两者之差；
+* push给读者时会同时推进该作者的已读序号，因此push过来的动态不会重复计数
+ */
+var advanceSeenScript = redis.NewScript(1, `
+for i = 1, #ARGV, 2 do
+	local seen = tonumber(redis.call('HGET', KEYS[1], ARGV[i]) or '0')
+	if tonumber(ARGV[i + 1]) > seen then
+		redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+	end
+end
+return 1`)
+
+//KEYS: 作者序号,事件分配的序号；ARGV: 事件序号保留的时间(s)
+var incrSeqScript = redis.NewScript(2, `
+local seq = redis.call('GET', KEYS[2])
+if seq then
+	return tonumber(seq)
+end
+seq = redis.call('INCR', KEYS[1])
+redis.call('SET', KEYS[2], seq, 'EX', ARGV[1])
+return seq`)
+
+/*
+* 作者发布动态时递增序号，返回新的序号；
+* 每个事件分配的序号保留[dedupe]的Window，重复投递或者重试的事件返回同一个序号，不会重复递增
+ */
+func incrPostSeq(author, event string) (uint64, error) {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return 0, ErrNilRedisConn
+	}
+	defer conn.Close()
+	return redis.Uint64(incrSeqScript.Do(conn, author+POSTSEQ, event+POSTSEQ, int64(config.Dedupe.Window/time.Second)))
+}
+
+/*
+* 计算读者对每个作者的未读数（序号差），同时返回读到的最新序号，
+* 没有记录过已读序号的作者视为没有未读，调用方推进已读序号后即完成初始化
+ */
+func getPullUnread(userID string, authors []uint64) (deltas, seqs map[string]uint64, err error) {
+	deltas = make(map[string]uint64)
+	seqs = make(map[string]uint64)
+	if len(authors) == 0 {
+		return deltas, seqs, nil
+	}
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return deltas, seqs, ErrNilRedisConn
+	}
+	defer conn.Close()
+
+	names := make([]string, 0, len(authors))
+	for _, author := range authors {
+		name := strconv.FormatUint(author, 10)
+		names = append(names, name)
+		conn.Send("GET", name+POSTSEQ)
+	}
+	conn.Send("HMGET", redis.Args{}.Add(userID+SEQSEEN).AddFlat(names)...)
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return deltas, seqs, err
+	}
+	seen, err := redis.Values(replies[len(names)], nil)
+	if err != nil {
+		return deltas, seqs, err
+	}
+	for i, name := range names {
+		seq, err := redis.Uint64(replies[i], nil)
+		if err != nil || seq == 0 {
+			continue
+		}
+		seqs[name] = seq
+		s, err := redis.Uint64(seen[i], nil)
+		if err != nil {
+			continue
+		}
+		if seq > s {
+			deltas[name] = seq - s
+		}
+	}
+	return deltas, seqs, nil
+}
+
+//将读者对各作者的已读序号推进到seqs（只增不减）
+func advanceSeqSeen(userID string, seqs map[string]uint64) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		return ErrNilRedisConn
+	}
+	defer conn.Close()
+	args := redis.Args{}.Add(userID + SEQSEEN)
+	for author, seq := range seqs {
+		args = args.Add(author, seq)
+	}
+	_, err := advanceSeenScript.Do(conn, args...)
+	return err
+}
+
+//清除读者对这些作者的pull未读，返回清除的条数
+func clearPullUnread(userID string, authors []uint64) (uint64, error) {
+	deltas, seqs, err := getPullUnread(userID, authors)
+	if err != nil {
+		return 0, err
+	}
+	var cleared uint64
+	for _, delta := range deltas {
+		cleared += delta
+	}
+	return cleared, advanceSeqSeen(userID, seqs)
+}
+
+//关注时从作者当前的序号开始计算未读，作者还没有动态时记为0
+func initSeqSeen(userID, author uint64) {
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		mpLogger.Error(ErrNilRedisConn)
+		return
+	}
+	defer conn.Close()
+	name := strconv.FormatUint(author, 10)
+	seq, err := redis.Uint64(conn.Do("GET", name+POSTSEQ))
+	if err != nil && err != redis.ErrNil {
+		mpLogger.Error(err, name)
+		return
+	}
+	if _, err = conn.Do("HSET", strconv.FormatUint(userID, 10)+SEQSEEN, name, seq); err != nil {
+		mpLogger.Error(err, userID, name)
+	}
+}
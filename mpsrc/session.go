@@ -0,0 +1,202 @@
+package mpsrc
+
+import (
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+* 读自己的写：发布、删除动态和变更关注关系时，在redis的userID+SESSION中记录还未写入mysql的操作，
+* consumer写入后按事件id清除；距上次写入同一类数据[session]的Window内，该用户的个人动态（或关注关系）
+* 不读缓存而读master，并合并仍未写入的操作，master的读取同时回写缓存。
+* 记录失败时只记录日志，退化为原来的最终一致
+ */
+const (
+	sessionLast   = "last:"
+	sessionPosts  = "post"
+	sessionAdd    = "add"
+	sessionDelete = "delete"
+)
+
+//一个还未写入mysql的操作
+type pendingWrite struct {
+	ID        string `json:"id"`
+	Op        string `json:"op"`
+	Timestamp uint64 `json:"ts,omitempty"`
+	ValueKey  string `json:"valuekey,omitempty"`
+	Value     string `json:"value,omitempty"` // 动态的内容，value可能也还未写入
+	Target    uint64 `json:"target,omitempty"`
+}
+
+type writeSession struct {
+	kinds     map[string]bool // 在Window内写入过的数据：sessionPosts、FANS或LIKES
+	posts     []*pendingWrite
+	relations map[string][]*pendingWrite
+}
+
+//id与记录的相同时才删除，同一个字段上更新的操作不受较早的事件影响
+var clearWriteScript = redis.NewScript(1, `
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if v and cjson.decode(v).id == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func postField(ts uint64) string {
+	return sessionPosts + ":" + strconv.FormatUint(ts, 10)
+}
+
+func relationField(infoType string, target uint64) string {
+	return infoType + ":" + strconv.FormatUint(target, 10)
+}
+
+//记录用户对kind的一次写入，并将会话延长到Window之后
+func recordWrite(userID, kind, field string, pw *pendingWrite) {
+	if config.Session.Window <= 0 || pw.ID == "" {
+		return
+	}
+	data, err := json.Marshal(pw)
+	if err != nil {
+		mpLogger.Error(err, userID, field)
+		return
+	}
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		mpLogger.Error(ErrNilRedisConn, userID)
+		return
+	}
+	defer conn.Close()
+	key := userID + SESSION
+	conn.Send("HSET", key, field, data)
+	conn.Send("HSET", key, sessionLast+kind, time.Now().Unix())
+	conn.Send("PEXPIRE", key, int64(config.Session.Window/time.Millisecond))
+	if _, err := conn.Do(""); err != nil {
+		mpLogger.Error(err, userID, field)
+	}
+}
+
+//consumer写入mysql后清除对应的操作
+func clearWrite(userID uint64, field, id string) {
+	if config.Session.Window <= 0 || id == "" {
+		return
+	}
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		mpLogger.Error(ErrNilRedisConn, userID)
+		return
+	}
+	defer conn.Close()
+	if _, err := clearWriteScript.Do(conn, strconv.FormatUint(userID, 10)+SESSION, field, id); err != nil {
+		mpLogger.Error(err, userID, field)
+	}
+}
+
+//返回用户的写会话，从master读取，刚记录的写入不受主从延迟影响；不在Window内或者redis不可用时返回nil
+func getSession(userID string) *writeSession {
+	if config.Session.Window <= 0 {
+		return nil
+	}
+	conn := redisPool.GetClient(true)
+	if conn == nil {
+		mpLogger.Error(ErrNilRedisConn, userID)
+		return nil
+	}
+	defer conn.Close()
+	fields, err := redis.StringMap(conn.Do("HGETALL", userID+SESSION))
+	if err != nil {
+		mpLogger.Error(err, userID)
+		return nil
+	}
+	return parseSession(fields)
+}
+
+func parseSession(fields map[string]string) *writeSession {
+	if len(fields) == 0 {
+		return nil
+	}
+	ws := &writeSession{kinds: make(map[string]bool), relations: make(map[string][]*pendingWrite)}
+	for field, value := range fields {
+		if strings.HasPrefix(field, sessionLast) {
+			ws.kinds[field[len(sessionLast):]] = true
+			continue
+		}
+		i := strings.Index(field, ":")
+		pw := new(pendingWrite)
+		if i <= 0 || json.Unmarshal([]byte(value), pw) != nil {
+			continue
+		}
+		if kind := field[:i]; kind == sessionPosts {
+			ws.posts = append(ws.posts, pw)
+		} else {
+			ws.relations[kind] = append(ws.relations[kind], pw)
+		}
+	}
+	return ws
+}
+
+//Window内是否写入过kind，需要读master
+func (ws *writeSession) wrote(kind string) bool {
+	return ws != nil && ws.kinds[kind]
+}
+
+//去掉还未删除的动态，并返回时间段(tb, te)内还未写入的动态，其ValueKey已经是动态的内容
+func (ws *writeSession) mergePosts(tls Timelines, uid, tb, te uint64) (Timelines, Timelines) {
+	added := make(Timelines, 0)
+	if len(ws.posts) == 0 {
+		return tls, added
+	}
+	ops := make(map[uint64]*pendingWrite, len(ws.posts))
+	for _, pw := range ws.posts {
+		ops[pw.Timestamp] = pw
+	}
+	merged := make(Timelines, 0, len(tls))
+	for _, tl := range tls {
+		if pw, ok := ops[tl.Timestamp]; ok {
+			if pw.Op == sessionDelete {
+				continue
+			}
+			//已经写入
+			delete(ops, tl.Timestamp)
+		}
+		merged = append(merged, tl)
+	}
+	for ts, pw := range ops {
+		if pw.Op == sessionAdd && ts > tb && ts < te {
+			added = append(added, &TimelineKey{UserID: uid, Timestamp: ts, ValueKey: pw.Value})
+		}
+	}
+	return merged, added
+}
+
+//合并还未写入的关注关系变更，新增的放在最后（关注时间最晚）
+func (ws *writeSession) mergeRelations(ids []uint64, infoType string) []uint64 {
+	pending := ws.relations[infoType]
+	if len(pending) == 0 {
+		return ids
+	}
+	ops := make(map[uint64]string, len(pending))
+	for _, pw := range pending {
+		ops[pw.Target] = pw.Op
+	}
+	merged := make([]uint64, 0, len(ids)+len(ops))
+	for _, id := range ids {
+		if op, ok := ops[id]; ok {
+			if op == sessionDelete {
+				continue
+			}
+			delete(ops, id)
+		}
+		merged = append(merged, id)
+	}
+	for _, pw := range pending {
+		if op, ok := ops[pw.Target]; ok && op == sessionAdd {
+			merged = append(merged, pw.Target)
+			delete(ops, pw.Target)
+		}
+	}
+	return merged
+}
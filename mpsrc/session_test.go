@@ -0,0 +1,65 @@
+package mpsrc
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseSession(t *testing.T) {
+	if ws := parseSession(map[string]string{}); ws.wrote(sessionPosts) {
+		t.Errorf("expected no session")
+	}
+	post, _ := json.Marshal(&pendingWrite{ID: "a", Op: sessionAdd, Timestamp: 5, Value: "v5"})
+	like, _ := json.Marshal(&pendingWrite{ID: "b", Op: sessionAdd, Target: 9})
+	ws := parseSession(map[string]string{
+		sessionLast + sessionPosts: "1",
+		postField(5):               string(post),
+		relationField(LIKES, 9):    string(like),
+		postField(6):               "broken",
+	})
+	if !ws.wrote(sessionPosts) || ws.wrote(LIKES) {
+		t.Errorf("unexpected kinds: %v", ws.kinds)
+	}
+	if len(ws.posts) != 1 || ws.posts[0].Value != "v5" {
+		t.Errorf("unexpected posts: %v", ws.posts)
+	}
+	if len(ws.relations[LIKES]) != 1 || ws.relations[LIKES][0].Target != 9 {
+		t.Errorf("unexpected relations: %v", ws.relations)
+	}
+}
+
+func TestMergePosts(t *testing.T) {
+	ws := &writeSession{posts: []*pendingWrite{
+		{Op: sessionAdd, Timestamp: 30, Value: "v30"},
+		{Op: sessionAdd, Timestamp: 20, Value: "v20"},
+		{Op: sessionDelete, Timestamp: 10},
+		{Op: sessionAdd, Timestamp: 100, Value: "v100"},
+	}}
+	tls := Timelines{
+		&TimelineKey{UserID: 1, Timestamp: 10, ValueKey: "k10"},
+		&TimelineKey{UserID: 1, Timestamp: 20, ValueKey: "k20"},
+	}
+	//10已删除，20已写入，100不在时间段内
+	merged, added := ws.mergePosts(tls, 1, 0, 50)
+	if len(merged) != 1 || merged[0].Timestamp != 20 {
+		t.Errorf("unexpected merged: %v", merged)
+	}
+	if len(added) != 1 || added[0].Timestamp != 30 || added[0].ValueKey != "v30" {
+		t.Errorf("unexpected added: %v", added)
+	}
+}
+
+func TestMergeRelations(t *testing.T) {
+	ws := &writeSession{relations: map[string][]*pendingWrite{LIKES: {
+		{Op: sessionAdd, Target: 4},
+		{Op: sessionDelete, Target: 2},
+		{Op: sessionAdd, Target: 3},
+	}}}
+	if got := ws.mergeRelations([]uint64{1, 2, 3}, LIKES); !reflect.DeepEqual(got, []uint64{1, 3, 4}) {
+		t.Errorf("expected: [1 3 4], got: %v", got)
+	}
+	if got := ws.mergeRelations([]uint64{1}, FANS); !reflect.DeepEqual(got, []uint64{1}) {
+		t.Errorf("expected: [1], got: %v", got)
+	}
+}
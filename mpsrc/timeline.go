@@ -3,23 +3,44 @@ package mpsrc
 import (
 	"encoding/json"
 	"feed/storage"
-	"github.com/Shopify/sarama"
 	"golang.org/x/net/context"
 	"sort"
 	"strconv"
-	"strings"
+	"time"
 )
 
 const (
 	DefaultNum          = 100
+	DefaultNotifyNum    = 20
 	PushLimitNum        = 200
 	DefaultExpireTime   = 300
 	DeleteTime          = 1
+	PullOnlyExpireTime  = 7 * 24 * 3600
+	MaxUnreadPosts      = 1000
+	UnreadBatchSize     = 100
+	FilterFansBatch     = 500
+	BreakdownScanCount  = 200
 	NEWEST              = "Newest"
 	FANS                = "Fans"
 	LIKES               = "Likes"
 	FRIENDS             = "Friends"
 	UNREAD              = "Unread"
+	UNREADPOSTS         = "UnreadPosts"
+	READCURSOR          = "ReadCursor"
+	POSTSEQ             = "PostSeq"
+	SEQSEEN             = "SeqSeen"
+	PUSHFANS            = "PushFans"
+	LISTS               = "Lists"
+	LIST                = "List:"
+	UnreadPost          = "post"
+	UnreadMention       = "mention"
+	UnreadComment       = "comment"
+	PULLONLY            = "PullOnly"
+	PULLONLYWINDOW      = "PullOnlyWindow"
+	NOTIFICATIONS       = "Notifications:"
+	NOTIFYVERSION       = "NotifyVersion"
+	NOTIFYCURSOR        = "NotifyCursor"
+	NOTIFYUNREAD        = "NotifyUnreadIDs"
 	FRIENDSTIMELINE     = "friendstimeline"
 	ADDPERSONALTIMELINE = "addpersonaltimeline"
 	DELPERSONALTIMELINE = "delpersonaltimeline"
@@ -29,6 +50,11 @@ const (
 	DELVALUE            = "delvalue"
 	ADDFANS             = "addfans"
 	DELFANS             = "delfans"
+	NOTIFICATION        = "notification"
+	DEADLETTER          = "deadletter"
+	PROCESSED           = "Processed:"
+	SESSION             = "Session"
+	LEASE               = "Lease:"
 )
 
 //动态的key及其属性，供排序用
@@ -70,8 +96,17 @@ func setItem(infos interface{}, cas uint64) (*storage.Item, []byte, error) {
 	return item, value, nil
 }
 
+//回写缓存，只写入PreferredStorage
+func setCache(key string, item *storage.Item) {
+	storageProxy.Set(storage.SetReadStrategyToContent(context.Background(), storage.CacheOnly), key, item)
+}
+
 func getFriendsInfo(userID, infoType string) []uint64 {
 	key := userID + infoType
+	//刚变更过关注关系，读master并合并还未写入的变更
+	if ws := getSession(userID); ws.wrote(infoType) {
+		return ws.mergeRelations(getFriendsInfoFromDB(userID, infoType, key, true), infoType)
+	}
 	ids := make([]uint64, 0)
 	rs := storageProxy.Get(storage.SetReadStrategyToContent(context.Background(), storage.CacheOnly), key)
 	if rs != nil {
@@ -83,33 +118,65 @@ func getFriendsInfo(userID, infoType string) []uint64 {
 		return ids
 	}
 	//查找DB，并回写cache
-	return getFriendsInfoFromDB(userID, infoType, key)
+	return getFriendsInfoFromDB(userID, infoType, key, false)
 }
 
-func updateFriendsInfo(info, userID, infoType, opt string) error {
-	switch infoType {
-	case FANS:
-		if opt == "add" {
-			producer.Input() <- &sarama.ProducerMessage{Topic: ADDFANS, Key: sarama.StringEncoder(userID),
-				Value: sarama.StringEncoder(info), Partition: 0}
-		} else if opt == "delete" {
-			producer.Input() <- &sarama.ProducerMessage{Topic: DELFANS, Key: sarama.StringEncoder(userID),
-				Value: sarama.StringEncoder(info), Partition: 0}
-		} else {
-			return ErrOpt
+//获取push集合内的粉丝，即按关注时间排序的前PushLimitNum个粉丝
+func getPushFans(userID string) []uint64 {
+	key := userID + PUSHFANS
+	ids := make([]uint64, 0)
+	rs := storageProxy.Get(storage.SetReadStrategyToContent(context.Background(), storage.CacheOnly), key)
+	if rs != nil {
+		if v, ok := rs.Value.([]byte); ok {
+			json.Unmarshal(v, &ids)
 		}
+		return ids
+	}
+	return getInfo("fanslist", "fid", userID, key, PushLimitNum, false)
+}
+
+func updateFriendsInfo(info, userID, infoType, opt string) error {
+	uid, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	target, err := strconv.ParseUint(info, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	event := &RelationEvent{UserID: uid, TargetID: target}
+	var env *Envelope
+	if config.Outbox.Enabled {
+		env, err = updateFriendsInfoWithOutbox(event, userID, infoType, opt)
+	} else {
+		switch infoType {
+		case FANS:
+			if opt == "add" {
+				env, err = publishCriticalEvent(ADDFANS, userID, event, time.Now(), Trace{})
+			} else if opt == "delete" {
+				env, err = publishCriticalEvent(DELFANS, userID, event, time.Now(), Trace{})
+			} else {
+				return ErrOpt
+			}
 
-	case LIKES:
-		if opt == "add" {
-			producer.Input() <- &sarama.ProducerMessage{Topic: ADDLIKES, Key: sarama.StringEncoder(userID),
-				Value: sarama.StringEncoder(info), Partition: 0}
-		} else if opt == "delete" {
-			producer.Input() <- &sarama.ProducerMessage{Topic: DELLIKES, Key: sarama.StringEncoder(userID),
-				Value: sarama.StringEncoder(info), Partition: 0}
-		} else {
-			return ErrOpt
+		case LIKES:
+			if opt == "add" {
+				if env, err = publishCriticalEvent(ADDLIKES, userID, event, time.Now(), Trace{}); err == nil {
+					//通知被关注的用户
+					sendNotification(info, NotifyFollow, userID, "", "", env.child())
+				}
+			} else if opt == "delete" {
+				env, err = publishCriticalEvent(DELLIKES, userID, event, time.Now(), Trace{})
+			} else {
+				return ErrOpt
+			}
 		}
 	}
+	if err != nil || env == nil {
+		return err
+	}
+	//读自己的写
+	recordWrite(userID, infoType, relationField(infoType, target), &pendingWrite{ID: env.ID, Op: opt, Target: target})
 	return nil
 }
 
@@ -117,33 +184,44 @@ func updateFriendsInfo(info, userID, infoType, opt string) error {
 func getPersonalTimelineKey(timestampBegin, timestampEnd, userID string) (Timelines, uint64, error) {
 	key := userID + timestampBegin + timestampEnd
 	tls := make(Timelines, 0)
-	rs := storageProxy.Get(storage.SetReadStrategyToContent(context.Background(), storage.CacheOnly), key)
-	if rs != nil {
-		if v, ok := rs.Value.([]byte); ok {
-			json.Unmarshal(v, &tls)
-			return tls, rs.DataVersion, nil
-		}
-		//脏数据，返回空数组
-		return tls, rs.DataVersion, nil
-	}
-
-	uid, err := strconv.Atoi(userID)
-	if err != nil {
-		return tls, 0, err
-	}
-	tsBegin, err := strconv.Atoi(timestampBegin)
-	if err != nil {
+	//未命中时同一个key只有一个请求查找DB并回写cache，其余的等待它的结果
+	rs, err := storageProxy.GetOrLoad(storage.SetReadStrategyToContent(context.Background(), storage.CacheOnly), key,
+		func(c context.Context, key string) (*storage.Item, error) {
+			uid, err := strconv.Atoi(userID)
+			if err != nil {
+				return nil, err
+			}
+			tsBegin, err := strconv.Atoi(timestampBegin)
+			if err != nil {
+				return nil, err
+			}
+			tsEnd, err := strconv.Atoi(timestampEnd)
+			if err != nil {
+				return nil, err
+			}
+			timelines, err := getPersonalTimelineKeyFromDB(uint64(uid), uint64(tsBegin), uint64(tsEnd), key, false)
+			if err != nil {
+				return nil, err
+			}
+			item, _, err := setItem(timelines, 0)
+			return item, err
+		})
+	if rs == nil {
 		return tls, 0, err
 	}
-	tsEnd, err := strconv.Atoi(timestampEnd)
-	if err != nil {
-		return tls, 0, err
+	if v, ok := rs.Value.([]byte); ok {
+		json.Unmarshal(v, &tls)
 	}
-	return getPersonalTimelineKeyFromDB(uint64(uid), uint64(tsBegin), uint64(tsEnd), key), 0, nil
+	//脏数据，返回空数组
+	return tls, rs.DataVersion, nil
 }
 
 //先取出Valuekey，然后取回真正的Value
 func getPersonalTimeline(timestampBegin, timestampEnd, userID string) (Timelines, error) {
+	//刚发布或删除过动态，读master并合并还未写入的动态
+	if ws := getSession(userID); ws.wrote(sessionPosts) {
+		return getPersonalTimelineOfSession(ws, timestampBegin, timestampEnd, userID)
+	}
 	tls, _, err := getPersonalTimelineKey(timestampBegin, timestampEnd, userID)
 	if err != nil {
 		return nil, err
@@ -153,56 +231,109 @@ func getPersonalTimeline(timestampBegin, timestampEnd, userID string) (Timelines
 	return MGetValue(tls), nil
 }
 
-func push(ts, valueKey, userID string, fans []uint64) {
+func getPersonalTimelineOfSession(ws *writeSession, timestampBegin, timestampEnd, userID string) (Timelines, error) {
+	uid, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	tsBegin, err := strconv.ParseUint(timestampBegin, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	tsEnd, err := strconv.ParseUint(timestampEnd, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	tls, err := getPersonalTimelineKeyFromDB(uid, tsBegin, tsEnd, userID+timestampBegin+timestampEnd, true)
+	if err != nil {
+		return nil, err
+	}
+	tls, added := ws.mergePosts(tls, uid, tsBegin, tsEnd)
+	tls = append(MGetValue(tls), added...)
+	sort.Sort(tls)
+	return tls, nil
+}
+
+func push(event *TimelineEvent, fans []uint64, publishedAt time.Time, trace Trace) {
 	for _, fan := range fans {
-		value := userID + "," + ts + "," + valueKey
-		producer.Input() <- &sarama.ProducerMessage{Topic: FRIENDSTIMELINE, Key: sarama.StringEncoder(strconv.Itoa(int(fan))),
-			Value: sarama.StringEncoder(value), Partition: 0}
+		produceEvent(FRIENDSTIMELINE, strconv.FormatUint(fan, 10), &PushEvent{
+			UserID:    fan,
+			Author:    event.UserID,
+			Timestamp: event.Timestamp,
+			ValueKey:  event.ValueKey,
+		}, publishedAt, trace)
 	}
 }
 
-func pushTimeline(ts, valueKey, userID string) {
-	//根据push规则(只推送给粉丝列表（有序的）前200的粉丝，超出部分pull)推送，先获取fans列表，然后异步推送（fans未读数过大，则不推送？？？）
-	fans := getFriendsInfo(userID, FANS)
-	if len(fans) <= PushLimitNum {
-		go push(ts, valueKey, userID, fans)
+func pushTimeline(userID, ts string, event *TimelineEvent, publishedAt time.Time, trace Trace) {
+	//写入过载时不push，由粉丝主动pull
+	if isPullOnly() {
+		markPullOnly(userID, ts)
 		return
 	}
-	go push(ts, valueKey, userID, fans[:PushLimitNum])
+	//根据push规则(只推送给粉丝列表（有序的）前200的粉丝，超出部分pull)推送，先获取push集合内的粉丝，然后异步推送
+	go push(event, getPushFans(userID), publishedAt, trace)
 }
 
-func addPersonalTimeline(userID, ts, valueKey string) {
-	value := ts + "," + valueKey
-	producer.Input() <- &sarama.ProducerMessage{Topic: ADDPERSONALTIMELINE, Key: sarama.StringEncoder(userID),
-		Value: sarama.StringEncoder(value), Partition: 0}
+func addPersonalTimeline(userID, ts, valueKey, value string) error {
+	uid, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	timestamp, err := strconv.ParseUint(ts, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	//发布时间，用于统计投递到粉丝inbox和未读数的延迟
+	publishedAt := time.Now()
+	event := &TimelineEvent{UserID: uid, Timestamp: timestamp, ValueKey: valueKey}
+	env, err := publishEvent(ADDPERSONALTIMELINE, userID, event, publishedAt, Trace{})
+	if err != nil {
+		return err
+	}
+	recordWrite(userID, sessionPosts, postField(timestamp), &pendingWrite{ID: env.ID, Op: sessionAdd, Timestamp: timestamp, ValueKey: valueKey, Value: value})
 	//粉丝未读数＋1
-	go func(userID string) {
-		producer.Input() <- &sarama.ProducerMessage{Topic: UNREAD, Key: sarama.StringEncoder("increase"),
-			Value: sarama.StringEncoder(userID), Partition: 0}
-
-	}(userID)
+	go produceEvent(UNREAD, userID, &UnreadChangeEvent{Op: "increase", Author: uid, Timestamp: timestamp, Type: UnreadPost},
+		publishedAt, env.child())
 	//异步push
-	go pushTimeline(ts, valueKey, userID)
+	go pushTimeline(userID, ts, event, publishedAt, env.child())
+	return nil
 }
 
-func delPersonalTimeline(userID, ts, value string) {
-	producer.Input() <- &sarama.ProducerMessage{Topic: DELPERSONALTIMELINE, Key: sarama.StringEncoder(userID),
-		Value: sarama.StringEncoder(ts), Partition: 0}
+func delPersonalTimeline(userID, ts, value string) error {
+	uid, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	timestamp, err := strconv.ParseUint(ts, 10, 64)
+	if err != nil {
+		return ErrID
+	}
+	if config.Outbox.Enabled {
+		return delPersonalTimelineWithOutbox(uid, timestamp, userID, value)
+	}
+	publishedAt := time.Now()
+	env, err := publishCriticalEvent(DELPERSONALTIMELINE, userID, &TimelineEvent{UserID: uid, Timestamp: timestamp}, publishedAt, Trace{})
+	if err != nil {
+		return err
+	}
+	recordWrite(userID, sessionPosts, postField(timestamp), &pendingWrite{ID: env.ID, Op: sessionDelete, Timestamp: timestamp})
 	//粉丝未读数－1
-	go func(userID string) {
-		select {
-		case producer.Input() <- &sarama.ProducerMessage{Topic: UNREAD, Key: sarama.StringEncoder("decrease"),
-			Value: sarama.StringEncoder(userID), Partition: 0}:
-		}
-	}(userID)
+	go produceEvent(UNREAD, userID, &UnreadChangeEvent{Op: "decrease", Author: uid, Timestamp: timestamp, Type: UnreadPost},
+		publishedAt, env.child())
 	//删除真正的value
-	DelValue(value)
+	return DelValue(value, env.child())
 }
 
-func getPullList(ids []uint64, friendsTimeline Timelines) []uint64 {
+//没有push到的关注对象，以及在时间段内有降级为只pull的动态的关注对象需要pull
+func getPullList(ids []uint64, friendsTimeline Timelines, pullOnlyAuthors map[uint64]bool) []uint64 {
 	pullList := make([]uint64, 0)
-	exist := false
 	for _, userID := range ids {
+		if pullOnlyAuthors[userID] {
+			pullList = append(pullList, userID)
+			continue
+		}
+		exist := false
 		for _, tl := range friendsTimeline {
 			if userID == tl.UserID {
 				exist = true
@@ -216,104 +347,127 @@ func getPullList(ids []uint64, friendsTimeline Timelines) []uint64 {
 	return pullList
 }
 
-func getMore() {
-	//TODO:
-	//增加是否获取nextkey的判断和操作,根据时间或者条数
+//去掉pull结果中已经push到的动态（同一作者既有push又有降级pull的情况）
+func dedupTimelines(pulled []Timelines, pushed Timelines) []Timelines {
+	type postID struct {
+		userID    uint64
+		timestamp uint64
+	}
+	exist := make(map[postID]bool, len(pushed))
+	for _, tl := range pushed {
+		exist[postID{tl.UserID, tl.Timestamp}] = true
+	}
+	for i, tls := range pulled {
+		kept := make(Timelines, 0, len(tls))
+		for _, tl := range tls {
+			if !exist[postID{tl.UserID, tl.Timestamp}] {
+				kept = append(kept, tl)
+			}
+		}
+		pulled[i] = kept
+	}
+	return pulled
 }
 
-//muti get
-func pullTimeline(pullList []uint64, pullChan chan Timelines, timestampBegin, timestampEnd string) {
-	var v []byte
-	personalTimeline := make(Timelines, 0)
-	keys := make([]string, 0)
-	for _, pull := range pullList {
-		key := strconv.Itoa(int(pull)) + timestampBegin + timestampEnd
-		keys = append(keys, key)
+//拉取单个关注对象的个人动态，并按时间升序排序
+func pullPersonalTimeline(userID uint64, timestampBegin, timestampEnd string) Timelines {
+	tls, _, err := getPersonalTimelineKey(timestampBegin, timestampEnd, strconv.FormatUint(userID, 10))
+	if err != nil {
+		mpLogger.Warn(err, userID)
+		return nil
 	}
+	sort.Sort(tls)
+	return tls
+}
 
-	rss := storageProxy.GetMulti(storage.SetReadStrategyToContent(context.Background(), storage.CacheOnly), keys...)
-	for _, key := range keys {
-		if rs, ok := rss[key]; !ok {
-			userID := strings.TrimSuffix(key, (timestampBegin + timestampEnd))
-			uid, _ := strconv.Atoi(userID)
-			tsBegin, _ := strconv.Atoi(timestampBegin)
-			tsEnd, _ := strconv.Atoi(timestampEnd)
-			personalTimeline = getPersonalTimelineKeyFromDB(uint64(uid), uint64(tsBegin), uint64(tsEnd), key)
-		} else {
-			if v, ok = rs.Value.([]byte); !ok {
-				continue
+/*
+* 并发拉取pull列表中每个关注对象的动态，同时进行的拉取数不超过配置的worker数，
+* 超过整体超时后不再等待剩余的结果，并通过partial告知调用方结果不完整
+ */
+func pullTimeline(pullList []uint64, timestampBegin, timestampEnd string) (sources []Timelines, partial bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Pull.Timeout)
+	defer cancel()
+	//带缓冲，超时后仍在执行的拉取不会阻塞
+	pullChan := make(chan Timelines, len(pullList))
+	workers := make(chan struct{}, config.Pull.Workers)
+	go func() {
+		for _, pull := range pullList {
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				return
 			}
-			json.Unmarshal(v, &personalTimeline)
+			go func(pull uint64) {
+				defer func() { <-workers }()
+				pullChan <- pullPersonalTimeline(pull, timestampBegin, timestampEnd)
+			}(pull)
 		}
-		pullChan <- personalTimeline
-	}
-}
+	}()
 
-func getPullReply(pullChan chan Timelines, pullFriendstimeline Timelines, pullNum, lenPullList int) Timelines {
-	for {
+	sources = make([]Timelines, 0, len(pullList))
+	for len(sources) < len(pullList) {
 		select {
-		//主动关闭chan
-		case personalTimeline := <-pullChan:
-			pullFriendstimeline = append(pullFriendstimeline, personalTimeline...)
-			pullNum += 1
-			if pullNum >= lenPullList {
-				close(pullChan)
-				return pullFriendstimeline
-			}
+		case tls := <-pullChan:
+			sources = append(sources, tls)
+		case <-ctx.Done():
+			mpLogger.Warn("pull timeline timeout, got ", len(sources), " of ", len(pullList))
+			return sources, true
 		}
 	}
+	return sources, false
 }
 
 /*
 *首先获取关注列表，确定没有得到push的列表，进行pull
-*综合结果，进行排序，提供按照不同属性的排序
-*删选出展示的key，去获取真正的内容，并返回
+*综合结果，进行k路归并，得到不超过limit条的动态
+*删选出展示的key，去获取真正的内容，并返回；partial表示有pull的来源超时
  */
-func getFriendsTimeline(timestampBegin, timestampEnd, userID string) (Timelines, error) {
+func getFriendsTimeline(timestampBegin, timestampEnd, userID string, limit int) (Timelines, bool, error) {
 	key := userID + FRIENDS + timestampBegin + timestampEnd
-	pullFriendstimeline := make(Timelines, 0)
 	pushFriendsTimeline := make(Timelines, 0)
-	//获取push到的内容
-	rs := storageProxy.Get(storage.SetReadStrategyToContent(context.Background(), storage.CacheMasterOnly), key)
-	if rs != nil {
-		if v, ok := rs.Value.([]byte); ok {
-			json.Unmarshal(v, &pushFriendsTimeline)
-		}
-	} else {
-		uid, err := strconv.Atoi(userID)
-		if err != nil {
-			return pushFriendsTimeline, err
-		}
-		tsBegin, err := strconv.Atoi(timestampBegin)
-		if err != nil {
-			return pushFriendsTimeline, err
-		}
-		tsEnd, err := strconv.Atoi(timestampEnd)
-		if err != nil {
-			return pushFriendsTimeline, err
-		}
-		pushFriendsTimeline, err = getPushFriendsTimelineFromDB(uint64(uid), uint64(tsBegin), uint64(tsEnd), key)
-
-		if err != nil {
-			return pushFriendsTimeline, err
-		}
+	//获取push到的内容，未命中时同一个key只有一个请求查找DB
+	rs, err := storageProxy.GetOrLoad(storage.SetReadStrategyToContent(context.Background(), storage.CacheMasterOnly), key,
+		func(c context.Context, key string) (*storage.Item, error) {
+			uid, err := strconv.Atoi(userID)
+			if err != nil {
+				return nil, err
+			}
+			tsBegin, err := strconv.Atoi(timestampBegin)
+			if err != nil {
+				return nil, err
+			}
+			tsEnd, err := strconv.Atoi(timestampEnd)
+			if err != nil {
+				return nil, err
+			}
+			timelines, err := getPushFriendsTimelineFromDB(uint64(uid), uint64(tsBegin), uint64(tsEnd), key)
+			if err != nil {
+				return nil, err
+			}
+			item, _, err := setItem(timelines, 0)
+			return item, err
+		})
+	if err != nil {
+		return pushFriendsTimeline, false, err
+	}
+	if v, ok := rs.Value.([]byte); ok {
+		json.Unmarshal(v, &pushFriendsTimeline)
 	}
+	sort.Sort(pushFriendsTimeline)
 	//获取关注列表
 	ids := getFriendsInfo(userID, LIKES)
 	//确定pull列表,并发拉取数据
-	pullList := getPullList(ids, pushFriendsTimeline)
-	lenPullList := len(pullList)
-	pullChan := make(chan Timelines, lenPullList)
-	pullNum := 0
-	if lenPullList == 0 {
-		goto RESULT
-	}
-	go pullTimeline(pullList, pullChan, timestampBegin, timestampEnd)
-	pullFriendstimeline = getPullReply(pullChan, pullFriendstimeline, pullNum, lenPullList)
-RESULT:
-	//综合结果，并排序，得到不超过默认数目的动态key数
-	timelines := append(pushFriendsTimeline, pullFriendstimeline...)
-	sort.Sort(timelines)
+	pullOnlyAuthors := getPullOnlyAuthors(ids, timestampBegin, timestampEnd)
+	pullList := getPullList(ids, pushFriendsTimeline, pullOnlyAuthors)
+	sources := []Timelines{pushFriendsTimeline}
+	partial := false
+	if len(pullList) > 0 {
+		var pulled []Timelines
+		pulled, partial = pullTimeline(pullList, timestampBegin, timestampEnd)
+		sources = append(sources, dedupTimelines(pulled, pushFriendsTimeline)...)
+	}
+	//综合结果，归并得到不超过limit条的动态key
+	timelines := mergeTimelines(sources, limit)
 	//获取Value，并返回
-	return MGetValue(timelines), nil
+	return MGetValue(timelines), partial, nil
 }
@@ -3,42 +3,56 @@ package mpsrc
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"github.com/Shopify/sarama"
-	"gitlab.meitu.com/platform/gocommons/storage"
 	"golang.org/x/net/context"
 	"io"
+	"strings"
+	"time"
 )
 
-//md5获取value生成的key，并将消息放入队列
-func StoreValue(value, userID string) string {
+//md5获取value生成的key
+func valueKeyOf(value, userID string) string {
 	h := md5.New()
 	//添加时间
 	io.WriteString(h, userID+value)
-	valueKey := hex.EncodeToString(h.Sum(nil))
-	producer.Input() <- &sarama.ProducerMessage{Topic: ADDVALUE, Key: sarama.StringEncoder(valueKey),
-			Value: sarama.StringEncoder(value), Partition: 0}
-	return valueKey
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//value的key为32位的md5；个人动态的key（用户id+时间段）全是数字，可能同样是32位，需要排除
+func isValueKey(key string) bool {
+	if len(key) != 2*md5.Size || strings.Trim(key, "0123456789") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+//生成value的key，并将消息放入队列
+func StoreValue(value, userID string) (string, error) {
+	valueKey := valueKeyOf(value, userID)
+	_, err := publishEvent(ADDVALUE, valueKey, &ValueEvent{Key: valueKey, Value: value}, time.Now(), Trace{})
+	return valueKey, err
 }
 //删除value
-func DelValue(value string) {
-	producer.Input() <- &sarama.ProducerMessage{Topic: DELVALUE, Key: sarama.StringEncoder(value),
-			Value: sarama.StringEncoder(""), Partition: 0}
+func DelValue(value string, trace Trace) error {
+	_, err := publishCriticalEvent(DELVALUE, value, &ValueEvent{Key: value}, time.Now(), trace)
+	return err
 }
 
-//查询key对应的value
+//查询key对应的value，缓存未命中的由proxy读取mysql并回写缓存，都没有时为空
 func MGetValue(tls Timelines) Timelines {
 	valueKeys := make([]string, 0)
 	for _, tl := range tls {
 		valueKeys = append(valueKeys, tl.ValueKey)
 	}
-	rss := storageProxy.GetMulti(storage.SetReadStrategyToContent(context.Background(), storage.CacheOnly), valueKeys...)
+	rss := storageProxy.GetMulti(context.Background(), valueKeys...)
 	for id, _ := range tls {
-		rs, ok := rss[tls[id].ValueKey]
-		if !ok {
-			tls[id].ValueKey = getValueFromDB(tls[id].ValueKey)
-		} else {
-			tls[id].ValueKey = string(rs.Value.([]byte))
+		value := ""
+		if rs, ok := rss[tls[id].ValueKey]; ok {
+			if v, ok := rs.Value.([]byte); ok {
+				value = string(v)
+			}
 		}
+		tls[id].ValueKey = value
 	}
 	return tls
 }
@@ -0,0 +1,17 @@
+package mpsrc
+
+import (
+	"testing"
+)
+
+func TestIsValueKey(t *testing.T) {
+	if !isValueKey(valueKeyOf("hello", "1")) {
+		t.Error("Test value key failed")
+	}
+	//个人动态、好友动态和关注列表的key
+	for _, key := range []string{"123456789012" + "1473350400" + "1473350500", "1" + FRIENDS + "14733504001473350500", "1" + LIKES} {
+		if isValueKey(key) {
+			t.Errorf("Test isValueKey failed, key: %v", key)
+		}
+	}
+}
@@ -0,0 +1,750 @@
+package mq
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// KafkaPublisher 基于sarama.AsyncProducer的Publisher，按Key的hash分区，
+// 后台读取每条消息的投递结果，同步发布的消息通过Metadata上的channel等待结果
+type KafkaPublisher struct {
+	producer sarama.AsyncProducer
+	opts     *Options
+
+	mu      sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	senders sync.WaitGroup // 正在放入发送队列的send
+	wg      sync.WaitGroup
+
+	sent   int64
+	acked  int64
+	failed int64
+}
+
+func NewKafkaPublisher(addrs []string, opts *Options) (*KafkaPublisher, error) {
+	cfg, err := newKafkaConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewAsyncProducer(addrs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	kp := &KafkaPublisher{producer: producer, opts: opts, closing: make(chan struct{})}
+	kp.wg.Add(1)
+	go kp.drain()
+	return kp, nil
+}
+
+func (kp *KafkaPublisher) Publish(msg *Message) error {
+	return kp.send(msg, nil)
+}
+
+func (kp *KafkaPublisher) PublishSync(msg *Message) error {
+	done := make(chan error, 1)
+	if err := kp.send(msg, done); err != nil {
+		return err
+	}
+	return <-done
+}
+
+// 只在检查closed时持有锁，发送队列满时阻塞到放入或者Close
+func (kp *KafkaPublisher) send(msg *Message, done chan error) error {
+	kp.mu.RLock()
+	if kp.closed {
+		kp.mu.RUnlock()
+		return ErrClosed
+	}
+	kp.senders.Add(1)
+	kp.mu.RUnlock()
+	defer kp.senders.Done()
+	pm := &sarama.ProducerMessage{
+		Topic: msg.Topic,
+		Key:   sarama.ByteEncoder(msg.Key),
+		Value: sarama.ByteEncoder(msg.Value),
+	}
+	if done != nil {
+		pm.Metadata = done
+	}
+	atomic.AddInt64(&kp.sent, 1)
+	select {
+	case kp.producer.Input() <- pm:
+		return nil
+	case <-kp.closing:
+		atomic.AddInt64(&kp.sent, -1)
+		return ErrClosed
+	}
+}
+
+// 读取投递结果，不读取时producer的结果channel写满后会阻塞Input
+func (kp *KafkaPublisher) drain() {
+	defer kp.wg.Done()
+	successes, errs := kp.producer.Successes(), kp.producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case pm, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			atomic.AddInt64(&kp.acked, 1)
+			kp.report(pm, nil)
+		case pe, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			atomic.AddInt64(&kp.failed, 1)
+			kp.report(pe.Msg, pe.Err)
+		}
+	}
+}
+
+func (kp *KafkaPublisher) report(pm *sarama.ProducerMessage, err error) {
+	if done, ok := pm.Metadata.(chan error); ok {
+		done <- err
+		return
+	}
+	if err != nil {
+		key, _ := pm.Key.Encode()
+		value, _ := pm.Value.Encode()
+		kp.opts.onError(&Message{Topic: pm.Topic, Key: key, Value: value, Partition: pm.Partition}, err)
+	}
+}
+
+func (kp *KafkaPublisher) Stats() PublisherStats {
+	stats := PublisherStats{
+		Sent:   atomic.LoadInt64(&kp.sent),
+		Acked:  atomic.LoadInt64(&kp.acked),
+		Failed: atomic.LoadInt64(&kp.failed),
+	}
+	stats.InFlight = stats.Sent - stats.Acked - stats.Failed
+	return stats
+}
+
+// Close 可以重复调用，等待已经放入发送队列的消息的投递结果，
+// 还在等待放入的send返回ErrClosed，之后才关闭producer，不会向关闭的Input发送
+func (kp *KafkaPublisher) Close() error {
+	kp.mu.Lock()
+	if kp.closed {
+		kp.mu.Unlock()
+		return nil
+	}
+	kp.closed = true
+	close(kp.closing)
+	kp.mu.Unlock()
+	kp.senders.Wait()
+	kp.producer.AsyncClose()
+	kp.wg.Wait()
+	return nil
+}
+
+// Rejected 判断投递失败是否因为消息本身不合法（太大、格式错误），这样的消息重试也不会成功
+func Rejected(err error) bool {
+	switch err {
+	case sarama.ErrMessageSizeTooLarge, sarama.ErrInvalidMessage, sarama.ErrInvalidMessageSize,
+		sarama.ErrInvalidTopic:
+		return true
+	}
+	return false
+}
+
+// kafka客户端的配置，消费组需要0.10.2.0以上的协议版本
+func newKafkaConfig(opts *Options) (*sarama.Config, error) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_10_2_0
+	//与Partition一致，同一个key总是写入同一个分区
+	cfg.Producer.Partitioner = sarama.NewHashPartitioner
+	//所有同步副本写入后才算投递成功，成功和失败的结果都由drain读取
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Return.Errors = true
+	if opts == nil {
+		return cfg, nil
+	}
+	if opts.Version != "" {
+		version, err := sarama.ParseKafkaVersion(opts.Version)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Version = version
+	}
+	cfg.Consumer.Offsets.Initial = opts.initialOffset()
+	if opts.CommitInterval > 0 {
+		cfg.Consumer.Offsets.AutoCommit.Interval = opts.CommitInterval
+	}
+	return cfg, nil
+}
+
+// KafkaSubscriber 基于sarama.ConsumerGroup的Subscriber，所有Subscribe的topic使用同一个消费组，
+// handler成功处理一条消息后才标记该消息的offset，由sarama定期提交
+type KafkaSubscriber struct {
+	addrs  []string
+	cfg    *sarama.Config
+	client sarama.Client       // 用于查询分区和提交重置的offset
+	admin  sarama.ClusterAdmin // 用于查询消费组的状态和已提交的offset
+	opts   *Options
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	subs      map[string]*kafkaSub
+	group     sarama.ConsumerGroup // 为空时在下一次加入时创建，重置offset时关闭
+	cancel    context.CancelFunc   // 退出当前的会话
+	started   bool
+	consuming bool // 正在Consume
+	paused    bool // 正在重置offset，暂停加入消费组
+	failed    bool // 本次会话有处理失败的消息，等待后重新加入
+	closed    bool
+	closing   chan struct{}
+	wg        sync.WaitGroup
+}
+
+// 一个topic的处理方式
+type kafkaSub struct {
+	handler  Handler
+	batch    BatchHandler // 不为空时批量处理
+	size     int
+	interval time.Duration
+}
+
+func NewKafkaSubscriber(addrs []string, opts *Options) (*KafkaSubscriber, error) {
+	cfg, err := newKafkaConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewClient(addrs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	ks := &KafkaSubscriber{
+		addrs:   addrs,
+		cfg:     cfg,
+		client:  client,
+		admin:   admin,
+		opts:    opts,
+		subs:    make(map[string]*kafkaSub),
+		closing: make(chan struct{}),
+	}
+	ks.cond = sync.NewCond(&ks.mu)
+	return ks, nil
+}
+
+func (ks *KafkaSubscriber) Subscribe(topics []string, handler Handler) error {
+	return ks.subscribe(topics, &kafkaSub{handler: handler})
+}
+
+func (ks *KafkaSubscriber) SubscribeBatch(topics []string, handler BatchHandler, size int, interval time.Duration) error {
+	if size <= 0 {
+		size = 1
+	}
+	return ks.subscribe(topics, &kafkaSub{batch: handler, size: size, interval: interval})
+}
+
+// 同一个topic后订阅的覆盖之前的，退出当前的会话，以新的topic列表重新加入消费组
+func (ks *KafkaSubscriber) subscribe(topics []string, sub *kafkaSub) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.closed {
+		return ErrClosed
+	}
+	for _, topic := range topics {
+		ks.subs[topic] = sub
+	}
+	if ks.cancel != nil {
+		ks.cancel()
+	}
+	if !ks.started {
+		ks.started = true
+		ks.wg.Add(1)
+		go ks.run()
+	}
+	return nil
+}
+
+// 每次重新平衡后Consume返回，循环重新加入消费组，直到关闭；
+// 处理失败退出的会话等待RedeliverDelay后再加入，从最后标记的offset重新投递
+func (ks *KafkaSubscriber) run() {
+	defer ks.wg.Done()
+	for {
+		group, topics, ctx, err := ks.join()
+		if err == ErrClosed {
+			return
+		}
+		if err == nil {
+			err = group.Consume(ctx, topics, ks)
+		}
+		failed := ks.leave()
+		switch {
+		case err != nil && err != sarama.ErrClosedConsumerGroup:
+			ks.opts.onError(&Message{Topic: strings.Join(topics, ",")}, err)
+			ks.sleep(time.Second)
+		case failed:
+			ks.sleep(ks.opts.redeliverDelay())
+		}
+	}
+}
+
+// 等待重置offset完成，消费组已经关闭时重新创建
+func (ks *KafkaSubscriber) join() (sarama.ConsumerGroup, []string, context.Context, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for ks.paused && !ks.closed {
+		ks.cond.Wait()
+	}
+	if ks.closed {
+		return nil, nil, nil, ErrClosed
+	}
+	topics := make([]string, 0, len(ks.subs))
+	for topic := range ks.subs {
+		topics = append(topics, topic)
+	}
+	if ks.group == nil {
+		group, err := sarama.NewConsumerGroup(ks.addrs, ks.opts.group(), ks.cfg)
+		if err != nil {
+			return nil, topics, nil, err
+		}
+		ks.group = group
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ks.cancel = cancel
+	ks.consuming = true
+	ks.failed = false
+	return ks.group, topics, ctx, nil
+}
+
+// 会话结束，返回会话中是否有处理失败的消息
+func (ks *KafkaSubscriber) leave() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.cancel != nil {
+		ks.cancel()
+		ks.cancel = nil
+	}
+	ks.consuming = false
+	ks.cond.Broadcast()
+	return ks.failed
+}
+
+func (ks *KafkaSubscriber) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ks.closing:
+	}
+}
+
+// 处理失败时不标记offset，记录后返回，ConsumeClaim返回后sarama会退出整个会话
+func (ks *KafkaSubscriber) redeliver(msg *Message, err error) {
+	ks.opts.onError(msg, err)
+	ks.mu.Lock()
+	ks.failed = true
+	ks.mu.Unlock()
+}
+
+func (ks *KafkaSubscriber) Setup(sess sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (ks *KafkaSubscriber) Cleanup(sess sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func newKafkaMessage(cm *sarama.ConsumerMessage, claim sarama.ConsumerGroupClaim) *Message {
+	return &Message{
+		Topic:         cm.Topic,
+		Key:           cm.Key,
+		Value:         cm.Value,
+		Partition:     cm.Partition,
+		Offset:        cm.Offset,
+		HighWaterMark: claim.HighWaterMarkOffset(),
+		Timestamp:     cm.Timestamp,
+	}
+}
+
+func (ks *KafkaSubscriber) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	ks.mu.Lock()
+	sub := ks.subs[claim.Topic()]
+	ks.mu.Unlock()
+	if sub.batch != nil {
+		return ks.consumeBatch(sub, sess, claim)
+	}
+	for cm := range claim.Messages() {
+		msg := newKafkaMessage(cm, claim)
+		if err := sub.handler(msg); err != nil {
+			ks.redeliver(msg, err)
+			return nil
+		}
+		sess.MarkMessage(cm, "")
+	}
+	return nil
+}
+
+// 攒够size条或者距这批第一条消息interval后处理一批，处理成功才标记最后一条消息的offset，
+// 失败时整批都不标记，退出会话后重新投递
+func (ks *KafkaSubscriber) consumeBatch(sub *kafkaSub, sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	var (
+		batch []*Message
+		last  *sarama.ConsumerMessage
+		timer <-chan time.Time
+	)
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		if err := sub.batch(batch); err != nil {
+			ks.redeliver(batch[len(batch)-1], err)
+			return false
+		}
+		sess.MarkMessage(last, "")
+		batch, timer = nil, nil
+		return true
+	}
+	for {
+		select {
+		case cm, ok := <-claim.Messages():
+			if !ok {
+				flush()
+				return nil
+			}
+			if len(batch) == 0 {
+				timer = time.After(sub.interval)
+			}
+			batch = append(batch, newKafkaMessage(cm, claim))
+			last = cm
+			if len(batch) >= sub.size && !flush() {
+				return nil
+			}
+		case <-timer:
+			if !flush() {
+				return nil
+			}
+		case <-sess.Context().Done():
+			flush()
+			return nil
+		}
+	}
+}
+
+/*
+* ResetOffset 通过OffsetManager直接提交消费组在各分区的offset，对所有分区生效：
+* 先关闭本实例的消费组并等待会话结束（结束时提交的offset不会覆盖重置的位置），
+* 消费组中还有其他实例时返回ErrGroupActive，需要先停止其他实例；提交后检查已提交的offset再恢复消费
+ */
+func (ks *KafkaSubscriber) ResetOffset(topic string, partition int32, offset int64) error {
+	ks.mu.Lock()
+	_, ok := ks.subs[topic]
+	ks.mu.Unlock()
+	if !ok {
+		return ErrNotSubscribed
+	}
+	offsets, err := ks.offsets(topic, partition, offset)
+	if err != nil {
+		return err
+	}
+	if err := ks.pause(); err != nil {
+		return err
+	}
+	defer ks.resume()
+	if err := ks.waitEmpty(); err != nil {
+		return err
+	}
+	if err := ks.commit(topic, offsets); err != nil {
+		return err
+	}
+	return ks.verify(topic, offsets)
+}
+
+// 分区重置到的具体offset
+func (ks *KafkaSubscriber) offsets(topic string, partition int32, offset int64) (map[int32]int64, error) {
+	partitions := []int32{partition}
+	if partition == AllPartitions {
+		var err error
+		if partitions, err = ks.client.Partitions(topic); err != nil {
+			return nil, err
+		}
+	}
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		target := offset
+		if offset == OffsetOldest || offset == OffsetNewest {
+			var err error
+			if target, err = ks.client.GetOffset(topic, p, offset); err != nil {
+				return nil, err
+			}
+		}
+		offsets[p] = target
+	}
+	return offsets, nil
+}
+
+// 关闭消费组离开，等待当前的会话结束并提交offset，同时只有一个重置
+func (ks *KafkaSubscriber) pause() error {
+	ks.mu.Lock()
+	for ks.paused && !ks.closed {
+		ks.cond.Wait()
+	}
+	if ks.closed {
+		ks.mu.Unlock()
+		return ErrClosed
+	}
+	ks.paused = true
+	group := ks.group
+	ks.group = nil
+	ks.mu.Unlock()
+	if group != nil {
+		if err := group.Close(); err != nil {
+			ks.opts.onError(&Message{}, err)
+		}
+	}
+	ks.mu.Lock()
+	for ks.consuming {
+		ks.cond.Wait()
+	}
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *KafkaSubscriber) resume() {
+	ks.mu.Lock()
+	ks.paused = false
+	ks.cond.Broadcast()
+	ks.mu.Unlock()
+}
+
+// 等待消费组没有成员，超过会话超时时间仍有成员时返回ErrGroupActive
+func (ks *KafkaSubscriber) waitEmpty() error {
+	deadline := time.Now().Add(ks.cfg.Consumer.Group.Session.Timeout)
+	for {
+		groups, err := ks.admin.DescribeConsumerGroups([]string{ks.opts.group()})
+		if err != nil {
+			return err
+		}
+		if len(groups) == 0 || groups[0].State == "Empty" || groups[0].State == "Dead" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrGroupActive
+		}
+		ks.sleep(500 * time.Millisecond)
+	}
+}
+
+func (ks *KafkaSubscriber) commit(topic string, offsets map[int32]int64) error {
+	om, err := sarama.NewOffsetManagerFromClient(ks.opts.group(), ks.client)
+	if err != nil {
+		return err
+	}
+	defer om.Close()
+	for partition, offset := range offsets {
+		pom, err := om.ManagePartition(topic, partition)
+		if err != nil {
+			return err
+		}
+		//ResetOffset只能后退，MarkOffset只能前进
+		pom.ResetOffset(offset, "")
+		pom.MarkOffset(offset, "")
+	}
+	om.Commit()
+	return nil
+}
+
+// Commit不返回错误，读取已提交的offset确认
+func (ks *KafkaSubscriber) verify(topic string, offsets map[int32]int64) error {
+	partitions := make([]int32, 0, len(offsets))
+	for partition := range offsets {
+		partitions = append(partitions, partition)
+	}
+	resp, err := ks.admin.ListConsumerGroupOffsets(ks.opts.group(), map[string][]int32{topic: partitions})
+	if err != nil {
+		return err
+	}
+	for partition, offset := range offsets {
+		block := resp.GetBlock(topic, partition)
+		if block == nil {
+			return ErrOffsetCommit
+		}
+		if block.Err != sarama.ErrNoError {
+			return block.Err
+		}
+		if block.Offset != offset {
+			return ErrOffsetCommit
+		}
+	}
+	return nil
+}
+
+// Close 退出消费组，等待正在处理的消息完成并提交offset
+func (ks *KafkaSubscriber) Close() error {
+	ks.mu.Lock()
+	if ks.closed {
+		ks.mu.Unlock()
+		return nil
+	}
+	ks.closed = true
+	close(ks.closing)
+	group := ks.group
+	ks.group = nil
+	ks.cond.Broadcast()
+	ks.mu.Unlock()
+	if group != nil {
+		if err := group.Close(); err != nil {
+			ks.opts.onError(&Message{}, err)
+		}
+	}
+	ks.wg.Wait()
+	//admin使用client，关闭时同时关闭client
+	return ks.admin.Close()
+}
+
+// KafkaReader 基于sarama.Consumer直接读取分区的Reader，不属于任何消费组
+type KafkaReader struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+
+	mu      sync.Mutex
+	closed  bool
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewKafkaReader(addrs []string, opts *Options) (*KafkaReader, error) {
+	cfg, err := newKafkaConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Consumer.Return.Errors = true
+	client, err := sarama.NewClient(addrs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &KafkaReader{client: client, consumer: consumer, closing: make(chan struct{})}, nil
+}
+
+func (kr *KafkaReader) ReadRange(topic string, r Range, handler Handler) error {
+	kr.mu.Lock()
+	if kr.closed {
+		kr.mu.Unlock()
+		return ErrClosed
+	}
+	kr.wg.Add(1)
+	kr.mu.Unlock()
+	defer kr.wg.Done()
+
+	partitions := []int32{r.Partition}
+	if r.Partition == AllPartitions {
+		var err error
+		if partitions, err = kr.client.Partitions(topic); err != nil {
+			return err
+		}
+	}
+	for _, p := range partitions {
+		if err := kr.readPartition(topic, p, r, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 分区的读取范围，按时间定位时没有不早于该时间的消息则为最新位置
+func (kr *KafkaReader) bounds(topic string, partition int32, r Range) (int64, int64, error) {
+	oldest, err := kr.client.GetOffset(topic, partition, OffsetOldest)
+	if err != nil {
+		return 0, 0, err
+	}
+	newest, err := kr.client.GetOffset(topic, partition, OffsetNewest)
+	if err != nil {
+		return 0, 0, err
+	}
+	start, end := r.offsets(oldest, newest)
+	offsetAt := func(t time.Time) (int64, error) {
+		offset, err := kr.client.GetOffset(topic, partition, t.UnixNano()/int64(time.Millisecond))
+		if err == nil && (offset == OffsetNewest || offset > newest) {
+			offset = newest
+		}
+		return offset, err
+	}
+	if !r.StartTime.IsZero() {
+		if start, err = offsetAt(r.StartTime); err != nil {
+			return 0, 0, err
+		}
+	}
+	if !r.EndTime.IsZero() {
+		if end, err = offsetAt(r.EndTime); err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, end, nil
+}
+
+func (kr *KafkaReader) readPartition(topic string, partition int32, r Range, handler Handler) error {
+	start, end, err := kr.bounds(topic, partition, r)
+	if err != nil || start >= end {
+		return err
+	}
+	pc, err := kr.consumer.ConsumePartition(topic, partition, start)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	for {
+		select {
+		case cm, ok := <-pc.Messages():
+			//compact之后offset可能不连续
+			if !ok || cm.Offset >= end {
+				return nil
+			}
+			msg := &Message{
+				Topic:         cm.Topic,
+				Key:           cm.Key,
+				Value:         cm.Value,
+				Partition:     cm.Partition,
+				Offset:        cm.Offset,
+				HighWaterMark: pc.HighWaterMarkOffset(),
+				Timestamp:     cm.Timestamp,
+			}
+			if err := handler(msg); err != nil {
+				return err
+			}
+			if cm.Offset+1 >= end {
+				return nil
+			}
+		case cerr := <-pc.Errors():
+			return cerr
+		case <-kr.closing:
+			return ErrClosed
+		}
+	}
+}
+
+// Close 可以重复调用，等待正在进行的ReadRange返回
+func (kr *KafkaReader) Close() error {
+	kr.mu.Lock()
+	if kr.closed {
+		kr.mu.Unlock()
+		return nil
+	}
+	kr.closed = true
+	close(kr.closing)
+	kr.mu.Unlock()
+	kr.wg.Wait()
+	if err := kr.consumer.Close(); err != nil {
+		kr.client.Close()
+		return err
+	}
+	return kr.client.Close()
+}
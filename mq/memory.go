@@ -0,0 +1,278 @@
+package mq
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMemoryPartitions = 8
+	DefaultMemoryRetention  = 10000
+)
+
+type memorySub struct {
+	topic     string
+	partition int32
+	next      int64 // 下一条要处理的消息的offset
+}
+
+type memoryPartition struct {
+	base     int64 // messages[0]的offset
+	messages []*Message
+}
+
+// MemoryBroker 进程内的队列，同时实现Publisher和Subscriber，
+// 每个topic有partitions个分区，按Key的hash分区，每个分区最多保留retention条消息，
+// 消费位置只保存在进程内，订阅从Options.InitialOffset开始
+type MemoryBroker struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	topics     map[string][]*memoryPartition
+	subs       []*memorySub
+	partitions int32
+	retention  int
+	closed     bool
+	closing    chan struct{}
+	wg         sync.WaitGroup
+	opts       *Options
+	sent       int64
+}
+
+func NewMemoryBroker(partitions int32, retention int, opts *Options) *MemoryBroker {
+	if partitions <= 0 {
+		partitions = DefaultMemoryPartitions
+	}
+	if retention <= 0 {
+		retention = DefaultMemoryRetention
+	}
+	b := &MemoryBroker{
+		topics:     make(map[string][]*memoryPartition),
+		partitions: partitions,
+		retention:  retention,
+		opts:       opts,
+		closing:    make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// 需要持有锁
+func (b *MemoryBroker) topic(name string) []*memoryPartition {
+	t, ok := b.topics[name]
+	if !ok {
+		t = make([]*memoryPartition, b.partitions)
+		for i := range t {
+			t[i] = &memoryPartition{}
+		}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *MemoryBroker) Publish(msg *Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	m := *msg
+	m.Partition = Partition(msg.Key, b.partitions)
+	p := b.topic(msg.Topic)[m.Partition]
+	m.Offset = p.base + int64(len(p.messages))
+	m.Timestamp = time.Now()
+	p.messages = append(p.messages, &m)
+	b.sent++
+	if len(p.messages) > b.retention {
+		drop := len(p.messages) - b.retention
+		p.messages = append(p.messages[:0], p.messages[drop:]...)
+		p.base += int64(drop)
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+// PublishSync 放入内存后即为确认
+func (b *MemoryBroker) PublishSync(msg *Message) error {
+	return b.Publish(msg)
+}
+
+func (b *MemoryBroker) Stats() PublisherStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return PublisherStats{Sent: b.sent, Acked: b.sent}
+}
+
+// Subscribe 每个分区一个goroutine
+func (b *MemoryBroker) Subscribe(topics []string, handler Handler) error {
+	return b.subscribe(topics, func(msgs []*Message) error {
+		return handler(msgs[0])
+	}, 1)
+}
+
+// SubscribeBatch 内存队列不等待interval，每次处理已经到达的最多size条消息
+func (b *MemoryBroker) SubscribeBatch(topics []string, handler BatchHandler, size int, interval time.Duration) error {
+	if size <= 0 {
+		size = 1
+	}
+	return b.subscribe(topics, handler, size)
+}
+
+func (b *MemoryBroker) subscribe(topics []string, handler BatchHandler, size int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	for _, name := range topics {
+		for partition, p := range b.topic(name) {
+			sub := &memorySub{topic: name, partition: int32(partition), next: p.base + int64(len(p.messages))}
+			if b.opts.initialOffset() == OffsetOldest {
+				sub.next = p.base
+			}
+			b.subs = append(b.subs, sub)
+			b.wg.Add(1)
+			go b.consume(sub, handler, size)
+		}
+	}
+	return nil
+}
+
+// 按顺序处理分区内的消息，落后超过保留的消息数时跳到最早保留的消息；
+// 处理失败时回到这批的第一条，等待RedeliverDelay后重新投递
+func (b *MemoryBroker) consume(sub *memorySub, handler BatchHandler, size int) {
+	defer b.wg.Done()
+	for {
+		b.mu.Lock()
+		p := b.topic(sub.topic)[sub.partition]
+		for !b.closed && sub.next >= p.base+int64(len(p.messages)) {
+			b.cond.Wait()
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		if sub.next < p.base {
+			sub.next = p.base
+		}
+		end := p.base + int64(len(p.messages))
+		if end > sub.next+int64(size) {
+			end = sub.next + int64(size)
+		}
+		batch := make([]*Message, 0, end-sub.next)
+		for offset := sub.next; offset < end; offset++ {
+			m := *p.messages[offset-p.base]
+			m.HighWaterMark = p.base + int64(len(p.messages))
+			batch = append(batch, &m)
+		}
+		//先前进，处理期间的重置不会被覆盖
+		sub.next = end
+		b.mu.Unlock()
+
+		if err := handler(batch); err != nil {
+			b.opts.onError(batch[len(batch)-1], err)
+			b.mu.Lock()
+			//处理期间重置过的保留重置的位置
+			if sub.next == end {
+				sub.next = batch[0].Offset
+			}
+			b.mu.Unlock()
+			select {
+			case <-time.After(b.opts.redeliverDelay()):
+			case <-b.closing:
+				return
+			}
+		}
+	}
+}
+
+func (b *MemoryBroker) ResetOffset(topic string, partition int32, offset int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.topic(topic)
+	if partition != AllPartitions && (partition < 0 || partition >= b.partitions) {
+		return ErrPartition
+	}
+	found := false
+	for _, sub := range b.subs {
+		if sub.topic != topic || (partition != AllPartitions && sub.partition != partition) {
+			continue
+		}
+		p := t[sub.partition]
+		switch offset {
+		case OffsetOldest:
+			sub.next = p.base
+		case OffsetNewest:
+			sub.next = p.base + int64(len(p.messages))
+		default:
+			sub.next = offset
+		}
+		found = true
+	}
+	if !found {
+		return ErrNotSubscribed
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+// ReadRange 读取分区内保留的消息，范围在开始读取时确定
+func (b *MemoryBroker) ReadRange(topic string, r Range, handler Handler) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	if r.Partition != AllPartitions && (r.Partition < 0 || r.Partition >= b.partitions) {
+		b.mu.Unlock()
+		return ErrPartition
+	}
+	var msgs []*Message
+	for i, p := range b.topic(topic) {
+		if r.Partition != AllPartitions && int32(i) != r.Partition {
+			continue
+		}
+		newest := p.base + int64(len(p.messages))
+		start, end := r.offsets(p.base, newest)
+		if !r.StartTime.IsZero() {
+			start = p.offsetAt(r.StartTime)
+		}
+		if !r.EndTime.IsZero() {
+			end = p.offsetAt(r.EndTime)
+		}
+		for offset := start; offset < end; offset++ {
+			m := *p.messages[offset-p.base]
+			m.HighWaterMark = newest
+			msgs = append(msgs, &m)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, msg := range msgs {
+		if err := handler(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 需要持有锁，返回第一条时间不早于t的消息的offset
+func (p *memoryPartition) offsetAt(t time.Time) int64 {
+	i := sort.Search(len(p.messages), func(i int) bool {
+		return !p.messages[i].Timestamp.Before(t)
+	})
+	return p.base + int64(i)
+}
+
+// Close 可以重复调用，等待正在处理的消息完成
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.closing)
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
@@ -0,0 +1,217 @@
+package mq
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	failed := make(chan *Message, 10)
+	b := NewMemoryBroker(1, 0, &Options{RedeliverDelay: time.Millisecond, OnError: func(msg *Message, err error) {
+		failed <- msg
+	}})
+	defer b.Close()
+
+	//订阅之前的消息不会收到
+	b.Publish(&Message{Topic: "t", Value: []byte("0")})
+	received := make(chan *Message, 10)
+	fail := true
+	b.Subscribe([]string{"t"}, func(msg *Message) error {
+		received <- msg
+		if string(msg.Value) == "2" && fail {
+			fail = false
+			return errors.New("failed")
+		}
+		return nil
+	})
+	b.Publish(&Message{Topic: "t", Value: []byte("1")})
+	b.Publish(&Message{Topic: "t", Value: []byte("2")})
+	b.Publish(&Message{Topic: "t", Value: []byte("3")})
+
+	//失败的消息重新投递，之后的消息不会越过它
+	for _, i := range []int64{1, 2, 2, 3} {
+		select {
+		case msg := <-received:
+			if msg.Offset != i || string(msg.Value) != string('0'+byte(i)) {
+				t.Errorf("expected: offset %d, got: %+v", i, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Test memory broker timeout")
+		}
+	}
+	select {
+	case msg := <-failed:
+		if msg.Offset != 2 {
+			t.Errorf("expected: %v, got: %v", 2, msg.Offset)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Test memory broker OnError timeout")
+	}
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	b := NewMemoryBroker(1, 0, nil)
+	b.Subscribe([]string{"t"}, func(msg *Message) error { return nil })
+	b.Close()
+	b.Close()
+	if err := b.Publish(&Message{Topic: "t"}); err != ErrClosed {
+		t.Errorf("expected: %v, got: %v", ErrClosed, err)
+	}
+}
+
+func TestMemoryBrokerResetOffset(t *testing.T) {
+	b := NewMemoryBroker(1, 0, &Options{InitialOffset: OffsetOldest})
+	defer b.Close()
+	if err := b.ResetOffset("t", AllPartitions, OffsetOldest); err != ErrNotSubscribed {
+		t.Errorf("expected: %v, got: %v", ErrNotSubscribed, err)
+	}
+
+	b.Publish(&Message{Topic: "t", Value: []byte("0")})
+	received := make(chan int64, 10)
+	b.Subscribe([]string{"t"}, func(msg *Message) error {
+		received <- msg.Offset
+		return nil
+	})
+	b.Publish(&Message{Topic: "t", Value: []byte("1")})
+	expected := []int64{0, 1, 0, 1}
+	for i, offset := range expected {
+		select {
+		case got := <-received:
+			if got != offset {
+				t.Errorf("expected: %v, got: %v", offset, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Test reset offset timeout")
+		}
+		//处理完之后从头重新消费
+		if i == 1 {
+			b.ResetOffset("t", AllPartitions, OffsetOldest)
+		}
+	}
+}
+
+func TestMemoryBrokerPartition(t *testing.T) {
+	b := NewMemoryBroker(4, 0, nil)
+	defer b.Close()
+	type record struct {
+		partition int32
+		value     string
+	}
+	received := make(chan record, 100)
+	b.Subscribe([]string{"t"}, func(msg *Message) error {
+		received <- record{msg.Partition, string(msg.Key) + ":" + string(msg.Value)}
+		return nil
+	})
+	keys := []string{"1", "2", "3", "4", "5"}
+	for i := 0; i < 4; i++ {
+		for _, key := range keys {
+			b.Publish(&Message{Topic: "t", Key: []byte(key), Value: []byte(strconv.Itoa(i))})
+		}
+	}
+
+	//同一个key在同一个分区内按发布的顺序消费
+	next := make(map[string]int)
+	for i := 0; i < len(keys)*4; i++ {
+		select {
+		case r := <-received:
+			kv := strings.SplitN(r.value, ":", 2)
+			if r.partition != Partition([]byte(kv[0]), 4) {
+				t.Errorf("expected: partition %d, got: %d", Partition([]byte(kv[0]), 4), r.partition)
+			}
+			if kv[1] != strconv.Itoa(next[kv[0]]) {
+				t.Errorf("expected: %s:%d, got: %s", kv[0], next[kv[0]], r.value)
+			}
+			next[kv[0]]++
+		case <-time.After(time.Second):
+			t.Fatal("Test partition timeout")
+		}
+	}
+}
+
+func TestMemoryBrokerStats(t *testing.T) {
+	b := NewMemoryBroker(1, 0, nil)
+	defer b.Close()
+	b.Publish(&Message{Topic: "t"})
+	if err := b.PublishSync(&Message{Topic: "t"}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := b.Stats(); stats != (PublisherStats{Sent: 2, Acked: 2}) {
+		t.Errorf("expected: 2 acked, got: %+v", stats)
+	}
+}
+
+func TestMemoryBrokerSubscribeBatch(t *testing.T) {
+	b := NewMemoryBroker(1, 0, &Options{InitialOffset: OffsetOldest})
+	defer b.Close()
+	for i := 0; i < 5; i++ {
+		b.Publish(&Message{Topic: "t", Value: []byte(strconv.Itoa(i))})
+	}
+	received := make(chan []*Message, 10)
+	b.SubscribeBatch([]string{"t"}, func(msgs []*Message) error {
+		received <- msgs
+		return nil
+	}, 2, time.Second)
+
+	//已经到达的消息每2条一批
+	for _, expected := range [][]int64{{0, 1}, {2, 3}, {4}} {
+		select {
+		case msgs := <-received:
+			if len(msgs) != len(expected) {
+				t.Fatalf("expected: %v, got: %d messages", expected, len(msgs))
+			}
+			for i, msg := range msgs {
+				if msg.Offset != expected[i] {
+					t.Errorf("expected: %v, got: %v", expected[i], msg.Offset)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Test subscribe batch timeout")
+		}
+	}
+}
+
+func TestMemoryBrokerReadRange(t *testing.T) {
+	b := NewMemoryBroker(1, 3, nil)
+	defer b.Close()
+	for i := 0; i < 4; i++ {
+		b.Publish(&Message{Topic: "t", Value: []byte(strconv.Itoa(i))})
+	}
+	read := func(r Range) string {
+		var values []string
+		if err := b.ReadRange("t", r, func(msg *Message) error {
+			values = append(values, string(msg.Value))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(values, ",")
+	}
+
+	//只保留最近3条
+	if got := read(Range{Start: OffsetOldest, End: OffsetNewest}); got != "1,2,3" {
+		t.Errorf("expected: 1,2,3, got: %v", got)
+	}
+	if got := read(Range{Start: 2, End: 3}); got != "2" {
+		t.Errorf("expected: 2, got: %v", got)
+	}
+	if got := read(Range{Start: OffsetOldest, End: OffsetNewest, StartTime: time.Now()}); got != "" {
+		t.Errorf("expected nothing after now, got: %v", got)
+	}
+
+	//handler出错时停止
+	stop := errors.New("stop")
+	calls := 0
+	err := b.ReadRange("t", Range{Start: OffsetOldest, End: OffsetNewest}, func(msg *Message) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("expected stop after 1 message, got: %v %d", err, calls)
+	}
+	if err := b.ReadRange("t", Range{Partition: 1}, nil); err != ErrPartition {
+		t.Errorf("expected: %v, got: %v", ErrPartition, err)
+	}
+}
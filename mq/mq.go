@@ -0,0 +1,175 @@
+// Package mq 对消息队列的抽象，业务代码只依赖Publisher和Subscriber，
+// 生产环境使用kafka，单机部署和测试使用进程内的内存队列
+package mq
+
+import (
+	"errors"
+	"hash/fnv"
+	"time"
+)
+
+var (
+	ErrClosed        error = errors.New("mq is closed")
+	ErrNotSubscribed error = errors.New("topic is not subscribed")
+	ErrPartition     error = errors.New("partition out of range")
+	ErrGroupActive   error = errors.New("consumer group has other active members")
+	ErrOffsetCommit  error = errors.New("offset is not committed")
+)
+
+// Message 队列中的一条消息，Key决定分区，相同Key的消息在同一分区内按顺序消费
+type Message struct {
+	Topic         string
+	Key           []byte
+	Value         []byte
+	Partition     int32
+	Offset        int64
+	HighWaterMark int64 // 分区内下一条消息的offset，用于计算积压
+	Timestamp     time.Time
+}
+
+// Handler 处理一条消息，同一分区内的消息按顺序处理
+type Handler func(msg *Message) error
+
+// BatchHandler 批量处理同一分区内连续的一批消息，返回后才提交这批消息的offset
+type BatchHandler func(msgs []*Message) error
+
+// ErrorHandler 处理失败（或投递失败）的消息
+type ErrorHandler func(msg *Message, err error)
+
+// Publisher 发布消息
+type Publisher interface {
+	// Publish 将消息放入发送队列后立即返回，投递失败时回调Options.OnError
+	Publish(msg *Message) error
+
+	// PublishSync 等待消息被队列确认（kafka为所有同步副本写入）后返回，用于关键的写入
+	PublishSync(msg *Message) error
+
+	// Stats 返回投递结果的统计
+	Stats() PublisherStats
+
+	// Close 停止发布，等待已经放入发送队列的消息投递完成
+	Close() error
+}
+
+// PublisherStats 投递结果的统计，InFlight为已发送但还没有结果的消息数
+type PublisherStats struct {
+	Sent     int64 `json:"sent"`
+	Acked    int64 `json:"acked"`
+	Failed   int64 `json:"failed"`
+	InFlight int64 `json:"in_flight"`
+}
+
+// Subscriber 以消费组的方式订阅消息，handler成功返回后才提交该消息的offset，
+// 返回错误时不提交，等待Options.RedeliverDelay后从这条消息重新投递；
+// 重启后从已提交的位置继续消费，没有提交过的从Options.InitialOffset开始
+type Subscriber interface {
+	// Subscribe 订阅topics，每个分区在独立的goroutine中调用handler，不阻塞
+	Subscribe(topics []string, handler Handler) error
+
+	// SubscribeBatch 与Subscribe相同，但每个分区攒够size条或者距这批第一条消息interval后调用一次handler
+	SubscribeBatch(topics []string, handler BatchHandler, size int, interval time.Duration) error
+
+	// ResetOffset 将topic分区的消费位置重置到offset，partition为AllPartitions时重置所有分区，
+	// offset可以是OffsetOldest、OffsetNewest或者具体的offset；kafka需要消费组中没有其他实例，否则返回ErrGroupActive
+	ResetOffset(topic string, partition int32, offset int64) error
+
+	// Close 停止所有订阅
+	Close() error
+}
+
+// Reader 按范围顺序读取topic的消息，不加入消费组也不提交offset，用于重放
+type Reader interface {
+	// ReadRange 逐个分区按offset顺序对范围内的消息调用handler，handler返回错误时停止并返回该错误
+	ReadRange(topic string, r Range, handler Handler) error
+
+	// Close 停止读取，正在进行的ReadRange返回ErrClosed
+	Close() error
+}
+
+// Range 读取的范围[Start, End)，可以是具体的offset、OffsetOldest或OffsetNewest（开始读取时的最新位置）；
+// StartTime、EndTime不为零时按消息的时间定位到第一条不早于该时间的消息，优先于offset
+type Range struct {
+	Partition int32 // AllPartitions表示所有分区
+	Start     int64
+	End       int64
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// 将offset换算到分区当前保留的范围，oldest为最早保留的offset，newest为下一条消息的offset
+func (r Range) offsets(oldest, newest int64) (int64, int64) {
+	start, end := r.Start, r.End
+	switch {
+	case start == OffsetNewest || start > newest:
+		start = newest
+	case start == OffsetOldest || start < oldest:
+		start = oldest
+	}
+	switch {
+	case end == OffsetNewest || end > newest:
+		end = newest
+	case end == OffsetOldest || end < oldest:
+		end = oldest
+	}
+	return start, end
+}
+
+const (
+	OffsetNewest  int64 = -1
+	OffsetOldest  int64 = -2
+	AllPartitions int32 = -1
+
+	DefaultGroup          = "feed"
+	DefaultRedeliverDelay = time.Second
+)
+
+type Options struct {
+	OnError ErrorHandler // handler返回错误时回调，为空时忽略
+
+	Group          string        // 消费组
+	InitialOffset  int64         // 没有提交过offset时的起始位置，OffsetOldest或OffsetNewest
+	CommitInterval time.Duration // 提交offset的间隔
+	Version        string        // kafka的协议版本，消费组至少需要0.10.2.0
+	RedeliverDelay time.Duration // handler返回错误后重新投递之前的等待时间
+}
+
+func (o *Options) group() string {
+	if o == nil || o.Group == "" {
+		return DefaultGroup
+	}
+	return o.Group
+}
+
+func (o *Options) initialOffset() int64 {
+	if o == nil || o.InitialOffset != OffsetOldest {
+		return OffsetNewest
+	}
+	return OffsetOldest
+}
+
+func (o *Options) redeliverDelay() time.Duration {
+	if o == nil || o.RedeliverDelay <= 0 {
+		return DefaultRedeliverDelay
+	}
+	return o.RedeliverDelay
+}
+
+func (o *Options) onError(msg *Message, err error) {
+	if o != nil && o.OnError != nil {
+		o.OnError(msg, err)
+	}
+}
+
+// Partition 按key的FNV-1a hash选择分区，与kafka生产者使用的sarama.HashPartitioner一致
+func Partition(key []byte, partitions int32) int32 {
+	if partitions <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	partition := int32(h.Sum32()) % partitions
+	if partition < 0 {
+		partition = -partition
+	}
+	return partition
+}
@@ -0,0 +1,115 @@
+package mq
+
+import (
+	"time"
+)
+
+const (
+	DefaultMaxAttempts    = 5
+	DefaultInitialBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff     = 10 * time.Second
+)
+
+// permanentError 重试也不会成功的错误，比如消息格式错误、违反唯一约束
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent 将err标记为不可重试
+func Permanent(err error) error {
+	if err == nil || IsPermanent(err) {
+		return err
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent 判断err是否为不可重试的错误
+func IsPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// Cause 去掉Permanent的包装，返回原始的错误
+func Cause(err error) error {
+	if pe, ok := err.(*permanentError); ok {
+		return pe.err
+	}
+	return err
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int           // 包括第一次在内的最大尝试次数
+	InitialBackoff time.Duration // 第一次重试前的等待时间，之后每次翻倍
+	MaxBackoff     time.Duration // 等待时间的上限
+}
+
+func (p *RetryPolicy) normalize() RetryPolicy {
+	policy := RetryPolicy{DefaultMaxAttempts, DefaultInitialBackoff, DefaultMaxBackoff}
+	if p == nil {
+		return policy
+	}
+	if p.MaxAttempts > 0 {
+		policy.MaxAttempts = p.MaxAttempts
+	}
+	if p.InitialBackoff > 0 {
+		policy.InitialBackoff = p.InitialBackoff
+	}
+	if p.MaxBackoff > 0 {
+		policy.MaxBackoff = p.MaxBackoff
+	}
+	return policy
+}
+
+// DeadHandler 处理不可重试或者重试耗尽的消息，attempts为已经尝试的次数
+type DeadHandler func(msg *Message, err error, attempts int) error
+
+// 按指数退避执行fn，直到成功、遇到不可重试的错误或者尝试MaxAttempts次
+func (p RetryPolicy) do(fn func() error) (int, error) {
+	backoff := p.InitialBackoff
+	attempts := 0
+	for {
+		err := fn()
+		attempts++
+		if err == nil || IsPermanent(err) || attempts >= p.MaxAttempts {
+			return attempts, err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// WithRetry 包装handler：可重试的错误按指数退避在原地重试，重试期间阻塞所在分区，保证同一key的顺序；
+// 不可重试的错误或者重试耗尽后交给dead处理，dead成功时视为该消息已处理
+func WithRetry(handler Handler, policy *RetryPolicy, dead DeadHandler) Handler {
+	p := policy.normalize()
+	return func(msg *Message) error {
+		attempts, err := p.do(func() error {
+			return handler(msg)
+		})
+		if err == nil || dead == nil {
+			return err
+		}
+		return dead(msg, Cause(err), attempts)
+	}
+}
+
+// WithBatchRetry 包装BatchHandler：整批按指数退避重试，不可重试的错误或者重试耗尽后交给fallback，
+// 比如逐条处理以隔离出错的消息
+func WithBatchRetry(handler BatchHandler, policy *RetryPolicy, fallback BatchHandler) BatchHandler {
+	p := policy.normalize()
+	return func(msgs []*Message) error {
+		_, err := p.do(func() error {
+			return handler(msgs)
+		})
+		if err == nil || fallback == nil {
+			return err
+		}
+		return fallback(msgs)
+	}
+}
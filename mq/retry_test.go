@@ -0,0 +1,79 @@
+package mq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithRetry(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	var (
+		calls     int
+		deadErr   error
+		deadTimes int
+	)
+	dead := func(msg *Message, err error, attempts int) error {
+		deadErr, deadTimes = err, attempts
+		return nil
+	}
+
+	//第二次成功
+	calls = 0
+	handler := WithRetry(func(msg *Message) error {
+		if calls++; calls < 2 {
+			return errors.New("retryable")
+		}
+		return nil
+	}, policy, dead)
+	if err := handler(&Message{}); err != nil || calls != 2 || deadErr != nil {
+		t.Errorf("Test retry failed, calls %d, err %v", calls, err)
+	}
+
+	//重试耗尽
+	calls = 0
+	retryable := errors.New("retryable")
+	handler = WithRetry(func(msg *Message) error {
+		calls++
+		return retryable
+	}, policy, dead)
+	if err := handler(&Message{}); err != nil || calls != 3 || deadErr != retryable || deadTimes != 3 {
+		t.Errorf("Test retry exhausted failed, calls %d, dead %v %d", calls, deadErr, deadTimes)
+	}
+
+	//不可重试的错误直接交给dead，并去掉包装
+	calls = 0
+	permanent := errors.New("permanent")
+	handler = WithRetry(func(msg *Message) error {
+		calls++
+		return Permanent(permanent)
+	}, policy, dead)
+	if err := handler(&Message{}); err != nil || calls != 1 || deadErr != permanent || deadTimes != 1 {
+		t.Errorf("Test permanent failed, calls %d, dead %v %d", calls, deadErr, deadTimes)
+	}
+
+	//没有dead时返回错误
+	handler = WithRetry(func(msg *Message) error {
+		return Permanent(permanent)
+	}, policy, nil)
+	if err := handler(&Message{}); !IsPermanent(err) {
+		t.Errorf("expected permanent error, got: %v", err)
+	}
+}
+
+func TestWithBatchRetry(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	calls := 0
+	var fallback []*Message
+	handler := WithBatchRetry(func(msgs []*Message) error {
+		calls++
+		return errors.New("retryable")
+	}, policy, func(msgs []*Message) error {
+		fallback = msgs
+		return nil
+	})
+	msgs := []*Message{{Offset: 1}, {Offset: 2}}
+	if err := handler(msgs); err != nil || calls != 2 || len(fallback) != 2 {
+		t.Errorf("Test batch retry failed, calls %d, fallback %d, err %v", calls, len(fallback), err)
+	}
+}
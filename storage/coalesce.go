@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrLoaderPanicked is returned to the callers waiting for a load whose loader
+// panicked, the caller running the loader gets the panic itself.
+var ErrLoaderPanicked = errors.New("storage: loader panicked")
+
+// Loader loads the item of a key missing in the preferred storage, e.g. from a
+// database query. A nil item is returned to the caller but not cached.
+type Loader func(c context.Context, key string) (*Item, error)
+
+// a load in flight, callers of the same key wait for it
+type loadCall struct {
+	wg   sync.WaitGroup
+	item *Item
+	err  error
+}
+
+type loadGroup struct {
+	refreshAhead time.Duration
+	now          func() time.Time
+
+	mu        sync.Mutex
+	calls     map[string]*loadCall
+	deadlines map[string]time.Time // expiration of the loaded keys, for early refresh
+	added     int
+}
+
+// EnableCoalescing makes GetOrLoad run one loader per key at a time, the other
+// callers of the key wait for its result. With refreshAhead greater than 0, a key
+// loaded by this process and read within refreshAhead before its expiration is
+// reloaded in the background while the callers still get the cached item.
+// It should be called before the proxy is used.
+func (s *DefaultProxy) EnableCoalescing(refreshAhead time.Duration) {
+	s.loads = &loadGroup{
+		refreshAhead: refreshAhead,
+		now:          time.Now,
+		calls:        make(map[string]*loadCall),
+		deadlines:    make(map[string]time.Time),
+	}
+}
+
+// GetOrLoad reads the key from the preferred storage according to the strategy in
+// the context (CacheMasterOnly reads the master), and on a miss loads it with the
+// loader and sets it back to the preferred storage.
+func (s *DefaultProxy) GetOrLoad(c context.Context, key string, loader Loader) (*Item, error) {
+	var item *Item
+	if GetReadStrategyFromContext(c) == CacheMasterOnly {
+		item = s.PreferredStorage.GetFromMaster(c, key)
+	} else {
+		item = s.PreferredStorage.Get(c, key)
+	}
+	if item != nil {
+		if s.loads != nil && s.loads.due(key) {
+			go s.load(c, key, loader)
+		}
+		return item, nil
+	}
+	return s.load(c, key, loader)
+}
+
+func (s *DefaultProxy) load(c context.Context, key string, loader Loader) (*Item, error) {
+	g := s.loads
+	if g == nil {
+		return s.loadAndSet(c, key, loader)
+	}
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.item, call.err
+	}
+	call := &loadCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	s.doLoad(c, key, loader, call)
+	return call.item, call.err
+}
+
+// doLoad runs the loader for the waiting callers, the call is finished even if
+// the loader panics so that the key is not blocked.
+func (s *DefaultProxy) doLoad(c context.Context, key string, loader Loader, call *loadCall) {
+	g := s.loads
+	returned := false
+	defer func() {
+		if !returned {
+			call.item, call.err = nil, ErrLoaderPanicked
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		if call.item != nil && call.err == nil {
+			g.loaded(key, call.item)
+		}
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+	call.item, call.err = s.loadAndSet(c, key, loader)
+	returned = true
+}
+
+func (s *DefaultProxy) loadAndSet(c context.Context, key string, loader Loader) (*Item, error) {
+	item, err := loader(c, key)
+	if err != nil || item == nil {
+		return item, err
+	}
+	s.PreferredStorage.Set(c, key, item)
+	return item, nil
+}
+
+// loaded records the expiration of a loaded item (ExpireAt is a relative seconds
+// from now, items without it never expire), g.mu must be held.
+func (g *loadGroup) loaded(key string, item *Item) {
+	if g.refreshAhead <= 0 || item.ExpireAt <= 0 {
+		return
+	}
+	now := g.now()
+	g.deadlines[key] = now.Add(time.Duration(item.ExpireAt) * time.Second)
+	// prune the expired keys once in a while
+	if g.added++; g.added >= 1024 {
+		g.added = 0
+		for k, deadline := range g.deadlines {
+			if !now.Before(deadline) {
+				delete(g.deadlines, k)
+			}
+		}
+	}
+}
+
+// due reports whether the key should be refreshed early, only one refresh of
+// a key is triggered.
+func (g *loadGroup) due(key string) bool {
+	if g.refreshAhead <= 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	deadline, ok := g.deadlines[key]
+	if !ok {
+		return false
+	}
+	now := g.now()
+	if !now.Before(deadline) {
+		delete(g.deadlines, key)
+		return false
+	}
+	if now.Before(deadline.Add(-g.refreshAhead)) {
+		return false
+	}
+	if _, loading := g.calls[key]; loading {
+		return false
+	}
+	delete(g.deadlines, key)
+	return true
+}
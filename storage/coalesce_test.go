@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestGetOrLoad(t *testing.T) {
+	cache := mapStorage{}
+	proxy := &DefaultProxy{PreferredStorage: cache}
+	proxy.EnableCoalescing(time.Second)
+	now := time.Now()
+	proxy.loads.now = func() time.Time { return now }
+
+	var loads int32
+	release := make(chan struct{})
+	loader := func(c context.Context, key string) (*Item, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return &Item{Value: []byte("v"), ExpireAt: 10}, nil
+	}
+
+	//并发的未命中只加载一次
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if item, err := proxy.GetOrLoad(nil, "k", loader); err != nil || item == nil {
+				t.Errorf("expected item, got: %v %v", item, err)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if loads != 1 || cache.Get(nil, "k") == nil {
+		t.Errorf("expected loaded once and set back, got: %d", loads)
+	}
+
+	//过期前refreshAhead内命中时在后台重新加载一次
+	proxy.GetOrLoad(nil, "k", loader)
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("expected no refresh, got: %d", n)
+	}
+	now = now.Add(9500 * time.Millisecond)
+	proxy.GetOrLoad(nil, "k", loader)
+	proxy.GetOrLoad(nil, "k", loader)
+	for i := 0; i < 100 && atomic.LoadInt32(&loads) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&loads); n != 2 {
+		t.Errorf("expected refreshed once, got: %d", n)
+	}
+}
+
+func TestGetOrLoadPanic(t *testing.T) {
+	proxy := &DefaultProxy{PreferredStorage: mapStorage{}}
+	proxy.EnableCoalescing(0)
+
+	var loads int32
+	release := make(chan struct{})
+	panicking := func(c context.Context, key string) (*Item, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		panic("boom")
+	}
+	leader := make(chan interface{})
+	go func() {
+		defer func() { leader <- recover() }()
+		proxy.GetOrLoad(nil, "k", panicking)
+	}()
+	for atomic.LoadInt32(&loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//等待中的调用者得到错误，执行loader的调用者得到panic
+	waiter := make(chan error)
+	go func() {
+		_, err := proxy.GetOrLoad(nil, "k", panicking)
+		waiter <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if r := <-leader; r != "boom" {
+		t.Errorf("expected the panic in the leader, got: %v", r)
+	}
+	if err := <-waiter; err != ErrLoaderPanicked {
+		t.Errorf("expected ErrLoaderPanicked, got: %v", err)
+	}
+
+	//之后的加载不受影响
+	item, err := proxy.GetOrLoad(nil, "k", func(c context.Context, key string) (*Item, error) {
+		return &Item{Value: []byte("v")}, nil
+	})
+	if err != nil || item == nil {
+		t.Errorf("expected item after the panic, got: %v %v", item, err)
+	}
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// entryOverhead approximates the memory used by an entry besides its key and value.
+const entryOverhead = 64
+
+// L1Storage is an in-process LRU cache stacked in front of another storage
+// (e.g., a MemcacheStorage). Entries live for a short TTL and the least recently
+// used ones are evicted when the total size exceeds MaxBytes. Writes and deletes
+// through the L1Storage go to the next storage and invalidate the local entry,
+// writes from other processes (or racing with a local miss) are only seen after the TTL.
+// All keys share the TTL, so only keys whose values rarely change (e.g., immutable
+// contents) should be cached, the others are filtered out with Cacheable.
+type L1Storage struct {
+	next    Storage
+	options L1StorageOptions
+	now     func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	bytes   int64
+	stats   L1Stats
+}
+
+type L1StorageOptions struct {
+	MaxBytes int64         // the size limit of keys and values in bytes
+	TTL      time.Duration // how long an entry lives, should be short
+	// Cacheable reports whether a key is cached locally, the other keys are always
+	// read from the next storage. All keys are cached if it is nil.
+	Cacheable func(key string) bool
+}
+
+type L1Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+}
+
+type l1Entry struct {
+	key      string
+	item     Item
+	size     int64
+	expireAt time.Time
+}
+
+func NewL1Storage(next Storage, options L1StorageOptions) *L1Storage {
+	return &L1Storage{
+		next:    next,
+		options: options,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func itemSize(key string, item *Item) int64 {
+	size := int64(len(key) + entryOverhead)
+	switch v := item.Value.(type) {
+	case []byte:
+		size += int64(len(v))
+	case string:
+		size += int64(len(v))
+	}
+	return size
+}
+
+func (l *L1Storage) cacheable(key string) bool {
+	return l.options.Cacheable == nil || l.options.Cacheable(key)
+}
+
+// get returns a copy of the local item, or nil if it is missing or expired.
+func (l *L1Storage) get(key string) *Item {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.entries[key]
+	if !ok {
+		l.stats.Misses++
+		return nil
+	}
+	entry := elem.Value.(*l1Entry)
+	if !l.now().Before(entry.expireAt) {
+		l.remove(elem)
+		l.stats.Misses++
+		return nil
+	}
+	l.lru.MoveToFront(elem)
+	l.stats.Hits++
+	item := entry.item
+	return &item
+}
+
+func (l *L1Storage) add(key string, item *Item) {
+	entry := &l1Entry{key: key, item: *item, size: itemSize(key, item), expireAt: l.now().Add(l.options.TTL)}
+	if entry.size > l.options.MaxBytes {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.entries[key]; ok {
+		l.remove(elem)
+	}
+	l.entries[key] = l.lru.PushFront(entry)
+	l.bytes += entry.size
+	for l.bytes > l.options.MaxBytes {
+		l.remove(l.lru.Back())
+		l.stats.Evictions++
+	}
+}
+
+func (l *L1Storage) remove(elem *list.Element) {
+	entry := l.lru.Remove(elem).(*l1Entry)
+	delete(l.entries, entry.key)
+	l.bytes -= entry.size
+}
+
+func (l *L1Storage) invalidate(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := l.entries[key]; ok {
+			l.remove(elem)
+		}
+	}
+}
+
+// Get retrieves a single value from the local cache or the next storage.
+func (l *L1Storage) Get(c context.Context, key string) *Item {
+	if !l.cacheable(key) {
+		return l.next.Get(c, key)
+	}
+	if item := l.get(key); item != nil {
+		return item
+	}
+	item := l.next.Get(c, key)
+	if item != nil {
+		l.add(key, item)
+	}
+	return item
+}
+
+// GetMulti retrieves multiple values, the missing ones from the next storage.
+func (l *L1Storage) GetMulti(c context.Context, keys ...string) map[string]*Item {
+	results := make(map[string]*Item, len(keys))
+	missing := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if l.cacheable(key) {
+			if item := l.get(key); item != nil {
+				results[key] = item
+				continue
+			}
+		}
+		missing = append(missing, key)
+	}
+	if len(missing) == 0 {
+		return results
+	}
+	for key, item := range l.next.GetMulti(c, missing...) {
+		if item != nil {
+			if l.cacheable(key) {
+				l.add(key, item)
+			}
+			results[key] = item
+		}
+	}
+	return results
+}
+
+// Set stores a single item into the next storage and invalidates the local one.
+func (l *L1Storage) Set(c context.Context, key string, item *Item) bool {
+	defer l.invalidate(key)
+	return l.next.Set(c, key, item)
+}
+
+// SetMulti stores multiple items into the next storage and invalidates the local ones.
+func (l *L1Storage) SetMulti(c context.Context, itemMap map[string]*Item) bool {
+	keys := make([]string, 0, len(itemMap))
+	for key := range itemMap {
+		keys = append(keys, key)
+	}
+	defer l.invalidate(keys...)
+	return l.next.SetMulti(c, itemMap)
+}
+
+// Delete removes a single item from the next storage and the local cache.
+func (l *L1Storage) Delete(c context.Context, key string) bool {
+	defer l.invalidate(key)
+	return l.next.Delete(c, key)
+}
+
+// GetFromMaster bypasses the local cache.
+func (l *L1Storage) GetFromMaster(c context.Context, key string) *Item {
+	return l.next.GetFromMaster(c, key)
+}
+
+// GetMultiFromMaster bypasses the local cache.
+func (l *L1Storage) GetMultiFromMaster(c context.Context, keys ...string) map[string]*Item {
+	return l.next.GetMultiFromMaster(c, keys...)
+}
+
+// Stats returns the hit/miss statistics and the current size.
+func (l *L1Storage) Stats() L1Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.Entries = l.lru.Len()
+	stats.Bytes = l.bytes
+	return stats
+}
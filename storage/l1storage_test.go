@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestL1Storage(t *testing.T) {
+	now := time.Now()
+	next := mapStorage{"a": &Item{Value: []byte("aaaa")}, "b": &Item{Value: []byte("bbbb")}}
+	size := itemSize("a", next["a"])
+	l1 := NewL1Storage(next, L1StorageOptions{MaxBytes: 2 * size, TTL: time.Second})
+	l1.now = func() time.Time { return now }
+
+	l1.Get(nil, "a")
+	next["a"] = &Item{Value: []byte("AAAA")}
+	if item := l1.Get(nil, "a"); string(item.Value.([]byte)) != "aaaa" {
+		t.Errorf("expected local hit, got: %s", item.Value)
+	}
+	//本地的写入使本地缓存失效
+	l1.Set(nil, "a", &Item{Value: []byte("cccc")})
+	if item := l1.Get(nil, "a"); string(item.Value.([]byte)) != "cccc" {
+		t.Errorf("expected invalidated, got: %s", item.Value)
+	}
+
+	//超过大小时淘汰最久未使用的
+	l1.GetMulti(nil, "b")
+	l1.Get(nil, "a")
+	next["c"] = &Item{Value: []byte("cccc")}
+	l1.Get(nil, "c")
+	if _, ok := l1.entries["b"]; ok {
+		t.Errorf("expected b evicted")
+	}
+
+	//过期后重新读取
+	next["a"] = &Item{Value: []byte("dddd")}
+	now = now.Add(time.Second)
+	if item := l1.Get(nil, "a"); string(item.Value.([]byte)) != "dddd" {
+		t.Errorf("expected expired, got: %s", item.Value)
+	}
+
+	stats := l1.Stats()
+	expected := L1Stats{Hits: 2, Misses: 5, Evictions: 1, Entries: 2, Bytes: 2 * size}
+	if stats != expected {
+		t.Errorf("expected: %+v, got: %+v", expected, stats)
+	}
+}
+
+func TestL1StorageCacheable(t *testing.T) {
+	next := mapStorage{"value": &Item{Value: []byte("v1")}, "timeline": &Item{Value: []byte("t1")}}
+	l1 := NewL1Storage(next, L1StorageOptions{MaxBytes: 1024, TTL: time.Second,
+		Cacheable: func(key string) bool { return key == "value" }})
+
+	l1.GetMulti(nil, "value", "timeline")
+	next["value"] = &Item{Value: []byte("v2")}
+	next["timeline"] = &Item{Value: []byte("t2")}
+	//只有可以缓存的key在本地命中，其余的每次读取下一层
+	items := l1.GetMulti(nil, "value", "timeline")
+	if string(items["value"].Value.([]byte)) != "v1" || string(items["timeline"].Value.([]byte)) != "t2" {
+		t.Errorf("expected value cached and timeline not, got: %s %s", items["value"].Value, items["timeline"].Value)
+	}
+	if item := l1.Get(nil, "timeline"); string(item.Value.([]byte)) != "t2" {
+		t.Errorf("expected timeline from the next storage, got: %s", item.Value)
+	}
+	if stats := l1.Stats(); stats.Entries != 1 {
+		t.Errorf("expected 1 entry, got: %d", stats.Entries)
+	}
+}
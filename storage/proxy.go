@@ -9,10 +9,25 @@ import (
 // ReadThroughProcessor will be called when read through happens
 type ReadThroughProcessor func(c context.Context, key string, item *Item, storage Storage)
 
+// NewSetBackProcessor returns a ReadThroughProcessor which sets the item read from
+// the backup storage back to the preferred storage. Items without an expiration
+// are set back with the given one (a relative seconds from now).
+func NewSetBackProcessor(expiration int64) ReadThroughProcessor {
+	return func(c context.Context, key string, item *Item, storage Storage) {
+		setBack := *item
+		if setBack.ExpireAt == 0 {
+			setBack.ExpireAt = expiration
+		}
+		storage.Set(c, key, &setBack)
+	}
+}
+
 // Proxy interface definition
 type Proxy interface {
 	GetMulti(c context.Context, keys ...string) map[string]*Item
 	Set(c context.Context, key string, item *Item) bool
+	SetMulti(c context.Context, itemMap map[string]*Item) bool
+	Delete(c context.Context, key string) bool
 	Get(c context.Context, key string) *Item
 	GetPreferredStorage() Storage
 	GetBackupStorage() Storage
@@ -47,11 +62,29 @@ func GetReadStrategyFromContext(c context.Context) ReadStrategy {
 	return rs
 }
 
+// WriteMode decides how the proxy writes an item to the preferred and backup storages.
+type WriteMode int
+
+const (
+	// WriteAround writes the backup storage and then deletes the key from the
+	// preferred storage, the next read will read it through.
+	WriteAround WriteMode = iota
+	// WriteThrough writes the backup storage and then the preferred storage,
+	// the preferred storage is left untouched if the backup write fails.
+	WriteThrough
+	// WriteBehind writes the preferred storage and queues the backup write,
+	// see StartWriteBehind.
+	WriteBehind
+)
+
 // DefaultProxy is default storage proxy interface implementation
 type DefaultProxy struct {
 	ReadThroughProcessor ReadThroughProcessor
 	PreferredStorage     Storage
 	BackupStorage        Storage
+	WriteMode            WriteMode
+	behind               *writeBehind
+	loads                *loadGroup
 }
 
 func (s *DefaultProxy) GetMulti(c context.Context, keys ...string) map[string]*Item {
@@ -101,12 +134,81 @@ func (s *DefaultProxy) GetMulti(c context.Context, keys ...string) map[string]*I
 	}
 }
 
+// writeStrategy returns the storages a write should go to. The strategy in the
+// context also applies to writes: CacheOnly and CacheMasterOnly write the preferred
+// storage only, DBOnly the backup storage only, and CacheAndDB follows the WriteMode.
+// Without a backup storage all writes go to the preferred storage.
+func (s *DefaultProxy) writeStrategy(c context.Context) ReadStrategy {
+	rs := GetReadStrategyFromContext(c)
+	if rs == CacheMasterOnly || (rs == CacheAndDB && s.BackupStorage == nil) {
+		return CacheOnly
+	}
+	return rs
+}
+
+// Set writes a single item, returns false if any of the writes required by the
+// WriteMode fails.
 func (s *DefaultProxy) Set(c context.Context, key string, item *Item) bool {
-	if s.BackupStorage != nil {
-		s.BackupStorage.Set(c, key, item)
+	switch s.writeStrategy(c) {
+	case CacheOnly:
+		return s.PreferredStorage.Set(c, key, item)
+	case DBOnly:
+		return s.BackupStorage.Set(c, key, item)
+	}
+	switch s.WriteMode {
+	case WriteThrough:
+		return s.BackupStorage.Set(c, key, item) && s.PreferredStorage.Set(c, key, item)
+	case WriteBehind:
+		ok := s.PreferredStorage.Set(c, key, item)
+		return s.writeBehind(c, key, item) && ok
+	default:
+		return s.BackupStorage.Set(c, key, item) && s.PreferredStorage.Delete(c, key)
+	}
+}
+
+// SetMulti writes multiple items in the same way as Set.
+func (s *DefaultProxy) SetMulti(c context.Context, itemMap map[string]*Item) bool {
+	switch s.writeStrategy(c) {
+	case CacheOnly:
+		return s.PreferredStorage.SetMulti(c, itemMap)
+	case DBOnly:
+		return s.BackupStorage.SetMulti(c, itemMap)
+	}
+	switch s.WriteMode {
+	case WriteThrough:
+		return s.BackupStorage.SetMulti(c, itemMap) && s.PreferredStorage.SetMulti(c, itemMap)
+	case WriteBehind:
+		ok := s.PreferredStorage.SetMulti(c, itemMap)
+		for key, item := range itemMap {
+			ok = s.writeBehind(c, key, item) && ok
+		}
+		return ok
+	default:
+		if !s.BackupStorage.SetMulti(c, itemMap) {
+			return false
+		}
+		ok := true
+		for key := range itemMap {
+			ok = s.PreferredStorage.Delete(c, key) && ok
+		}
+		return ok
+	}
+}
+
+// Delete removes a single item from both storages. With WriteBehind the backup
+// delete is queued after the pending writes of the same key.
+func (s *DefaultProxy) Delete(c context.Context, key string) bool {
+	switch s.writeStrategy(c) {
+	case CacheOnly:
+		return s.PreferredStorage.Delete(c, key)
+	case DBOnly:
+		return s.BackupStorage.Delete(c, key)
+	}
+	if s.WriteMode == WriteBehind {
+		ok := s.PreferredStorage.Delete(c, key)
+		return s.writeBehind(c, key, nil) && ok
 	}
-	// return s.PreferredStorage.Set(c, key, item)
-	return false
+	return s.BackupStorage.Delete(c, key) && s.PreferredStorage.Delete(c, key)
 }
 
 func (s *DefaultProxy) Get(c context.Context, key string) *Item {
@@ -121,7 +223,7 @@ func (s *DefaultProxy) Get(c context.Context, key string) *Item {
 	default:
 		result := s.PreferredStorage.Get(c, key)
 		if result == nil && s.BackupStorage != nil {
-			if result = s.BackupStorage.Get(c, key); result != nil {
+			if result = s.BackupStorage.Get(c, key); result != nil && s.ReadThroughProcessor != nil {
 				s.ReadThroughProcessor(c, key, result, s.PreferredStorage)
 			}
 		}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// mapStorage is an in-memory Storage, safe for the proxy's concurrent writes
+type mapStorage map[string]*Item
+
+var mapMu sync.Mutex
+
+func (m mapStorage) Get(c context.Context, key string) *Item {
+	mapMu.Lock()
+	defer mapMu.Unlock()
+	return m[key]
+}
+
+func (m mapStorage) GetMulti(c context.Context, keys ...string) map[string]*Item {
+	mapMu.Lock()
+	defer mapMu.Unlock()
+	items := make(map[string]*Item)
+	for _, key := range keys {
+		if item, ok := m[key]; ok {
+			items[key] = item
+		}
+	}
+	return items
+}
+
+func (m mapStorage) Set(c context.Context, key string, item *Item) bool {
+	return m.SetMulti(c, map[string]*Item{key: item})
+}
+
+func (m mapStorage) SetMulti(c context.Context, itemMap map[string]*Item) bool {
+	mapMu.Lock()
+	defer mapMu.Unlock()
+	for key, item := range itemMap {
+		m[key] = item
+	}
+	return true
+}
+
+func (m mapStorage) Delete(c context.Context, key string) bool {
+	mapMu.Lock()
+	defer mapMu.Unlock()
+	delete(m, key)
+	return true
+}
+
+func (m mapStorage) GetFromMaster(c context.Context, key string) *Item {
+	return m.Get(c, key)
+}
+
+func (m mapStorage) GetMultiFromMaster(c context.Context, keys ...string) map[string]*Item {
+	return m.GetMulti(c, keys...)
+}
+
+func TestReadThrough(t *testing.T) {
+	cache := mapStorage{"a": &Item{Value: []byte("1")}}
+	db := mapStorage{"b": &Item{Value: []byte("2")}, "c": &Item{Value: []byte("3"), ExpireAt: 5}}
+	proxy := &DefaultProxy{
+		PreferredStorage:     cache,
+		BackupStorage:        db,
+		ReadThroughProcessor: NewSetBackProcessor(300),
+	}
+
+	items := proxy.GetMulti(nil, "a", "b", "c", "d")
+	if len(items) != 3 || string(items["b"].Value.([]byte)) != "2" {
+		t.Errorf("unexpected items: %v", items)
+	}
+	//未命中的回写缓存，没有过期时间的使用默认值
+	if item := cache["b"]; item == nil || item.ExpireAt != 300 {
+		t.Errorf("expected b set back with expiration 300, got: %v", item)
+	}
+	if item := cache["c"]; item == nil || item.ExpireAt != 5 {
+		t.Errorf("expected c set back with expiration 5, got: %v", item)
+	}
+	if _, ok := cache["d"]; ok {
+		t.Errorf("expected d not set back")
+	}
+
+	delete(cache, "b")
+	if item := proxy.Get(nil, "b"); item == nil || cache["b"] == nil {
+		t.Errorf("expected b read through, got: %v", item)
+	}
+}
+
+func TestReadWithoutProcessor(t *testing.T) {
+	cache := mapStorage{}
+	proxy := &DefaultProxy{PreferredStorage: cache, BackupStorage: mapStorage{"b": &Item{Value: []byte("2")}}}
+	//没有ReadThroughProcessor时只读取，不回写
+	if item := proxy.Get(nil, "b"); item == nil || cache["b"] != nil {
+		t.Errorf("expected b read without set back, got: %v", item)
+	}
+	if items := proxy.GetMulti(nil, "b"); len(items) != 1 || cache["b"] != nil {
+		t.Errorf("expected b read without set back, got: %v", items)
+	}
+}
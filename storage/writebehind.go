@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var errWriteBehind = errors.New("write behind to backup storage failed")
+
+// a queued backup write, a nil item means delete
+type writeOp struct {
+	c    context.Context
+	key  string
+	item *Item
+}
+
+type WriteBehindOptions struct {
+	QueueSize int           // the bound of each worker's queue
+	Workers   int           // the number of workers
+	Retries   int           // how many times a failed backup write is retried
+	Backoff   time.Duration // the wait before the first retry, doubled after each
+	LE        func(c context.Context, err error, v ...interface{})
+}
+
+type WriteBehindStats struct {
+	Pending int   `json:"pending"`
+	Written int64 `json:"written"`
+	Retried int64 `json:"retried"`
+	Failed  int64 `json:"failed"` // given up after the retries, the preferred key was deleted
+}
+
+type writeBehind struct {
+	options WriteBehindOptions
+	mu      sync.RWMutex
+	closed  bool
+	queues  []chan *writeOp
+	wg      sync.WaitGroup
+
+	written int64
+	retried int64
+	failed  int64
+}
+
+// StartWriteBehind starts the workers writing queued items to the backup storage
+// for WriteBehind. Each worker owns a queue bounded by options.QueueSize, and the
+// writes of a key always go to the same worker so they are applied in order. Writers
+// block while the queue is full. A failed backup write is retried with backoff, and
+// after the retries it is logged and the key is deleted from the preferred storage,
+// so readers fall back to the backup instead of a value it never got.
+// It should be called before the proxy is used, writes before it or after
+// StopWriteBehind are made synchronously.
+func (s *DefaultProxy) StartWriteBehind(options WriteBehindOptions) {
+	if options.QueueSize <= 0 {
+		options.QueueSize = 1
+	}
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	if options.LE == nil {
+		options.LE = func(c context.Context, err error, v ...interface{}) {}
+	}
+	wb := &writeBehind{options: options, queues: make([]chan *writeOp, options.Workers)}
+	for i := range wb.queues {
+		queue := make(chan *writeOp, options.QueueSize)
+		wb.queues[i] = queue
+		wb.wg.Add(1)
+		go func() {
+			defer wb.wg.Done()
+			for op := range queue {
+				s.applyWriteBehind(wb, op)
+			}
+		}()
+	}
+	s.behind = wb
+}
+
+func (s *DefaultProxy) applyWriteBehind(wb *writeBehind, op *writeOp) {
+	backoff := wb.options.Backoff
+	for attempt := 0; ; attempt++ {
+		if s.writeBackup(op.c, op.key, op.item) {
+			atomic.AddInt64(&wb.written, 1)
+			return
+		}
+		if attempt >= wb.options.Retries {
+			break
+		}
+		atomic.AddInt64(&wb.retried, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	atomic.AddInt64(&wb.failed, 1)
+	wb.options.LE(op.c, errWriteBehind, " key: ", op.key)
+	if !s.PreferredStorage.Delete(op.c, op.key) {
+		wb.options.LE(op.c, errWriteBehind, " and failed to delete the preferred key: ", op.key)
+	}
+}
+
+// StopWriteBehind stops queueing and waits until the queued writes are done,
+// later writes are made synchronously.
+func (s *DefaultProxy) StopWriteBehind() {
+	wb := s.behind
+	if wb == nil {
+		return
+	}
+	wb.mu.Lock()
+	if !wb.closed {
+		wb.closed = true
+		for _, queue := range wb.queues {
+			close(queue)
+		}
+	}
+	wb.mu.Unlock()
+	wb.wg.Wait()
+}
+
+// WriteBehindStats returns the number of queued backup writes and the results of the done ones.
+func (s *DefaultProxy) WriteBehindStats() WriteBehindStats {
+	wb := s.behind
+	if wb == nil {
+		return WriteBehindStats{}
+	}
+	stats := WriteBehindStats{
+		Written: atomic.LoadInt64(&wb.written),
+		Retried: atomic.LoadInt64(&wb.retried),
+		Failed:  atomic.LoadInt64(&wb.failed),
+	}
+	for _, queue := range wb.queues {
+		stats.Pending += len(queue)
+	}
+	return stats
+}
+
+func (wb *writeBehind) enqueue(op *writeOp) bool {
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	if wb.closed {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(op.key))
+	wb.queues[h.Sum32()%uint32(len(wb.queues))] <- op
+	return true
+}
+
+func (s *DefaultProxy) writeBackup(c context.Context, key string, item *Item) bool {
+	if item == nil {
+		return s.BackupStorage.Delete(c, key)
+	}
+	return s.BackupStorage.Set(c, key, item)
+}
+
+// writeBehind queues the backup write, or makes it synchronously if write behind is not running.
+func (s *DefaultProxy) writeBehind(c context.Context, key string, item *Item) bool {
+	if s.behind != nil && s.behind.enqueue(&writeOp{c: c, key: key, item: item}) {
+		return true
+	}
+	return s.writeBackup(c, key, item)
+}
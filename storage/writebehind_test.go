@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestWriteModes(t *testing.T) {
+	item := &Item{Value: []byte("v")}
+
+	cache, db := mapStorage{"k": &Item{Value: []byte("old")}}, mapStorage{}
+	proxy := &DefaultProxy{PreferredStorage: cache, BackupStorage: db}
+	if !proxy.Set(nil, "k", item) || db["k"] != item || cache["k"] != nil {
+		t.Errorf("write around: expected written to db and deleted from cache, got: %v %v", db, cache)
+	}
+
+	cache, db = mapStorage{}, mapStorage{}
+	proxy = &DefaultProxy{PreferredStorage: cache, BackupStorage: db, WriteMode: WriteThrough}
+	if !proxy.SetMulti(nil, map[string]*Item{"a": item, "b": item}) || len(db) != 2 || len(cache) != 2 {
+		t.Errorf("write through: expected written to both, got: %v %v", db, cache)
+	}
+	//CacheOnly只写缓存
+	if !proxy.Set(SetReadStrategyToContent(context.Background(), CacheOnly), "c", item) || db["c"] != nil || cache["c"] != item {
+		t.Errorf("cache only: expected written to cache only, got: %v %v", db, cache)
+	}
+	if !proxy.Delete(nil, "a") || db["a"] != nil || cache["a"] != nil {
+		t.Errorf("expected a deleted from both, got: %v %v", db, cache)
+	}
+
+	cache, db = mapStorage{}, mapStorage{}
+	proxy = &DefaultProxy{PreferredStorage: cache, BackupStorage: db, WriteMode: WriteBehind}
+	proxy.StartWriteBehind(WriteBehindOptions{QueueSize: 4, Workers: 2})
+	proxy.Set(nil, "a", item)
+	proxy.Set(nil, "b", item)
+	proxy.Delete(nil, "b")
+	proxy.StopWriteBehind()
+	if cache["a"] != item || db["a"] != item || db["b"] != nil {
+		t.Errorf("write behind: expected a written and b deleted, got: %v %v", db, cache)
+	}
+	if stats := proxy.WriteBehindStats(); stats != (WriteBehindStats{Written: 3}) {
+		t.Errorf("expected 3 written, got: %+v", stats)
+	}
+}
+
+// failingStorage fails the first fails writes
+type failingStorage struct {
+	mapStorage
+	fails int32
+}
+
+func (f *failingStorage) Set(c context.Context, key string, item *Item) bool {
+	if atomic.AddInt32(&f.fails, -1) >= 0 {
+		return false
+	}
+	return f.mapStorage.Set(c, key, item)
+}
+
+func TestWriteBehindFailure(t *testing.T) {
+	item := &Item{Value: []byte("v")}
+	cache, db := mapStorage{}, &failingStorage{mapStorage: mapStorage{}, fails: 2}
+	proxy := &DefaultProxy{PreferredStorage: cache, BackupStorage: db, WriteMode: WriteBehind}
+	var logged int32
+	proxy.StartWriteBehind(WriteBehindOptions{Retries: 1, Backoff: time.Millisecond, LE: func(c context.Context, err error, v ...interface{}) {
+		atomic.AddInt32(&logged, 1)
+	}})
+	//重试后仍然失败，删除缓存
+	proxy.Set(nil, "a", item)
+	proxy.StopWriteBehind()
+	if cache["a"] != nil || db.mapStorage["a"] != nil || logged != 1 {
+		t.Errorf("expected a deleted from cache and logged, got: %v %v %d", cache, db.mapStorage, logged)
+	}
+	if stats := proxy.WriteBehindStats(); stats != (WriteBehindStats{Retried: 1, Failed: 1}) {
+		t.Errorf("expected 1 failed, got: %+v", stats)
+	}
+}
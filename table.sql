@@ -24,7 +24,8 @@ create table valuestore (
   vid BIGINT NOT NULL AUTO_INCREMENT,
   valuekey  varchar(255) not null,
   value varchar(255),
-  primary key(vid, valuekey, value)
+  primary key(vid, valuekey, value),
+  unique key(valuekey)
 )engine=InnoDB default charset=utf8;
 
 drop table if exists likeslist;
@@ -55,3 +56,56 @@ create table pushfriendstimeline (
  valuekey varchar(255) not null,
  primary key(uid, lid, ts, valuekey)
 )engine=InnoDB default charset=utf8;
+
+drop table if exists notification;
+
+# gkey: 合并通知的依据，点赞和转发为动态的key，关注为空，评论和提及每条唯一
+# dkey: 去重的依据，关注为关注的时间（重新关注时产生新的通知），其余与gkey相同
+create table notification (
+ id BIGINT not null AUTO_INCREMENT,
+ uid BIGINT not null,
+ type varchar(16) not null,
+ actor BIGINT not null,
+ target varchar(64) not null,
+ gkey varchar(128) not null,
+ dkey varchar(128) not null,
+ content varchar(1024) not null,
+ ts BIGINT not null,
+ primary key(id),
+ unique key(uid, type, actor, dkey),
+ key(uid, type, gkey)
+)engine=InnoDB default charset=utf8;
+
+drop table if exists deadletter;
+
+# 不可重试或者重试耗尽的队列消息，value为原始的消息内容
+create table deadletter (
+ id BIGINT not null AUTO_INCREMENT,
+ topic varchar(64) not null,
+ msgkey varchar(255) not null,
+ value text not null,
+ partitionid int not null,
+ msgoffset BIGINT not null,
+ error varchar(1024) not null,
+ attempts int not null,
+ ts BIGINT not null,
+ primary key(id),
+ key(topic, id)
+)engine=InnoDB default charset=utf8;
+
+drop table if exists outbox;
+
+# 与主表在同一个事务内写入的事件，由relay放入队列后标记为已发送
+# sent: 0未发送，1已发送，2多次发送失败后搁置；attempts: 发送失败的次数；retry_at: 下次发送的时间(ms)
+create table outbox (
+ id BIGINT not null AUTO_INCREMENT,
+ topic varchar(64) not null,
+ msgkey varchar(255) not null,
+ value text not null,
+ sent tinyint not null default 0,
+ attempts int not null default 0,
+ retry_at BIGINT not null default 0,
+ ts BIGINT not null,
+ primary key(id),
+ key(sent, id)
+)engine=InnoDB default charset=utf8;